@@ -1,5 +1,7 @@
 package main
 
+import "runtime/debug"
+
 var (
 	version   = "dev"
 	buildTime = "unknown"
@@ -9,3 +11,13 @@ var (
 func main() {
 	Execute()
 }
+
+func buildVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
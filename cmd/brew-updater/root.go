@@ -1,48 +1,100 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/spf13/cobra"
 
+	"github.com/samzong/brew-updater/internal/api"
 	"github.com/samzong/brew-updater/internal/brew"
 	"github.com/samzong/brew-updater/internal/check"
 	"github.com/samzong/brew-updater/internal/config"
 	"github.com/samzong/brew-updater/internal/launchd"
 	"github.com/samzong/brew-updater/internal/lock"
+	applog "github.com/samzong/brew-updater/internal/log"
+	"github.com/samzong/brew-updater/internal/power"
 	"github.com/samzong/brew-updater/internal/tui"
+	vcmp "github.com/samzong/brew-updater/internal/version"
 )
 
+const lockTTL = 10 * time.Minute
+
 var (
-	cfgPath string
-	quiet   bool
-	verbose bool
+	cfgPath    string
+	statePath  string
+	outputPath string
+	logFormat  string
+	quiet      bool
+	verbose    bool
+
+	stdout io.Writer = os.Stdout
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "brew-updater",
 	Short: "Aggressive Homebrew updater",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if outputPath == "" {
+			return nil
+		}
+		f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		stdout = f
+		brew.Output = f
+		return nil
+	},
+	PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+		if f, ok := stdout.(*os.File); ok && f != os.Stdout {
+			return f.Close()
+		}
+		return nil
+	},
 }
 
 func Execute() {
 	rootCmd.SilenceErrors = true
 	rootCmd.SilenceUsage = true
 	if err := rootCmd.Execute(); err != nil {
+		var ee *exitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.code)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// exitError ends the process with a specific code and no message
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgPath, "config", "", "config file path")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "", "text|json; json logs check events as one object per line (default from config)")
+	rootCmd.PersistentFlags().StringVarP(&outputPath, "output", "o", "", "append command output to this file instead of stdout")
+	rootCmd.PersistentFlags().StringVar(&statePath, "state", "", "state file path (default next to config, or $"+config.StatePathEnv+")")
 	rootCmd.PersistentFlags().BoolVar(&quiet, "quiet", false, "reduce output")
 	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "verbose output")
 
@@ -52,11 +104,22 @@ func init() {
 	rootCmd.AddCommand(checkCmd())
 	rootCmd.AddCommand(upgradeCmd())
 	rootCmd.AddCommand(statusCmd())
+	rootCmd.AddCommand(statsCmd())
 	rootCmd.AddCommand(setCmd())
 	rootCmd.AddCommand(launchdCmd())
+	rootCmd.AddCommand(selfUpgradeCmd())
+	rootCmd.AddCommand(migrateStateCmd())
+	rootCmd.AddCommand(configCmd())
+	rootCmd.AddCommand(doctorCmd())
+	rootCmd.AddCommand(uninstallCmd())
+	rootCmd.AddCommand(dumpCmd())
+	rootCmd.AddCommand(debugCmd())
 }
 
 func initCmd() *cobra.Command {
+	var force bool
+	var yes bool
+	var keepWatchlist bool
 	cmd := &cobra.Command{
 		Use:   "init",
 		Short: "Initialize config and state",
@@ -65,28 +128,91 @@ func initCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			if _, err := os.Stat(path); err == nil {
-				return fmt.Errorf("config already exists: %s", path)
-			}
+			stPath := config.ResolveStatePath(statePath, path)
 			cfg := config.DefaultConfig()
 			st := config.DefaultState()
+			if _, err := os.Stat(path); err == nil {
+				if !force {
+					return fmt.Errorf("config already exists: %s", path)
+				}
+				if keepWatchlist {
+					old, err := config.LoadConfig(path)
+					if err != nil {
+						return fmt.Errorf("cannot keep watchlist, config is unreadable: %w", err)
+					}
+					cfg.Watchlist = old.Watchlist
+				}
+				if !yes && !confirm(fmt.Sprintf("Reset %s and %s to defaults?", path, stPath)) {
+					return errors.New("aborted")
+				}
+				for _, f := range []string{path, stPath} {
+					if err := backupFile(f); err != nil {
+						return err
+					}
+				}
+			}
 			if err := config.SaveConfig(path, cfg); err != nil {
 				return err
 			}
-			if err := config.SaveState(config.StatePathFromConfigPath(path), st); err != nil {
+			if err := config.SaveState(stPath, st); err != nil {
 				return err
 			}
-			fmt.Println("Initialized:", path)
+			fmt.Fprintln(stdout, "Initialized:", path)
 			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&force, "force", false, "overwrite an existing config and state with defaults (old files are kept as .bak)")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "do not ask for confirmation")
+	cmd.Flags().BoolVar(&keepWatchlist, "keep-watchlist", false, "with --force, keep the watched packages")
 	return cmd
 }
 
+// copies path to path.bak, replacing an older backup
+func backupFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".bak", data, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "backup:", path+".bak")
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// prompts go to stderr so -o files and JSON output stay clean
+func confirm(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func watchCmd() *cobra.Command {
 	var typ string
 	var policy string
 	var interval int
+	var dryRun bool
+	var allowEmpty bool
+	var showVersions bool
+	var intervalPreset string
+	var sinceVersion bool
+	var fromBrewfile string
+	var keepExisting bool
+	var all bool
+	var yes bool
+	var leavesOnly bool
+	var mergeFrom string
+	var onConflict string
+	var interactive bool
 	cmd := &cobra.Command{
 		Use:   "watch",
 		Short: "Select packages to watch",
@@ -98,44 +224,58 @@ func watchCmd() *cobra.Command {
 			if err := validateType(typ); err != nil {
 				return err
 			}
+			if mergeFrom != "" {
+				return mergeWatchlist(cfg, st, path, statePath, mergeFrom, onConflict, typ, sinceVersion, dryRun)
+			}
 
 			formulae, casks, err := brew.ListInstalled()
 			if err != nil {
 				return err
 			}
+			var leaves map[string]bool
+			if leavesOnly {
+				if leaves, err = brew.Leaves(); err != nil {
+					return err
+				}
+			}
 			existing := map[string]config.WatchItem{}
 			for _, w := range cfg.Watchlist {
 				existing[config.WatchKey(w.Name, w.Type)] = w
 			}
 
-			items := []tui.Item{}
-			if typ == "formula" {
-				for name := range formulae {
-					items = append(items, tui.Item{Name: name, Type: "formula"})
+			latest := func(name, typ string) string {
+				if v, ok := st.LastVersions[config.WatchKey(name, typ)]; ok {
+					return v
 				}
-			} else if typ == "cask" {
-				for name := range casks {
-					items = append(items, tui.Item{Name: name, Type: "cask"})
-				}
-			} else {
-				for name := range formulae {
-					items = append(items, tui.Item{Name: name, Type: "formula"})
+				return st.LastVersions[name]
+			}
+			items := []tui.Item{}
+			if typ != "cask" {
+				for name, version := range formulae {
+					// already watched dependencies stay listed so they are not dropped silently
+					if _, watched := existing[config.WatchKey(name, "formula")]; leaves != nil && !leaves[name] && !watched {
+						continue
+					}
+					items = append(items, tui.Item{Name: name, Type: "formula", Installed: version, Latest: latest(name, "formula")})
 				}
-				for name := range casks {
-					items = append(items, tui.Item{Name: name, Type: "cask"})
+			}
+			if typ != "formula" {
+				for name, version := range casks {
+					items = append(items, tui.Item{Name: name, Type: "cask", Installed: version, Latest: latest(name, "cask")})
 				}
 			}
 
 			if len(items) == 0 {
-				fmt.Println("No new packages to watch")
+				fmt.Fprintln(stdout, "No new packages to watch")
 				return nil
 			}
 			sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
 			if err := validatePolicy(policy); err != nil {
 				return err
 			}
-			if interval != 0 && (interval < config.MinIntervalMin || interval > config.MaxIntervalMin) {
-				return errors.New("interval-min must be 1-1440")
+			interval, err = resolveInterval(interval, intervalPreset)
+			if err != nil {
+				return err
 			}
 			defaultPolicy := cfg.DefaultPolicy
 			defaultInterval := config.DefaultIntervalMin
@@ -146,26 +286,61 @@ func watchCmd() *cobra.Command {
 				defaultInterval = interval
 			}
 
+			// already watched packages start from their saved settings; with
+			// --keep-existing-settings=false, explicit --policy/--interval flags
+			// replace those too. new selections always get the defaults above
 			preset := map[string]tui.Selection{}
 			for _, item := range items {
 				key := config.WatchKey(item.Name, item.Type)
 				if w, ok := existing[key]; ok {
-					preset[key] = tui.Selection{
+					sel := tui.Selection{
 						Name:        item.Name,
 						Type:        item.Type,
 						Policy:      w.Policy,
 						IntervalMin: w.IntervalMin,
 					}
+					if !keepExisting {
+						if policy != "" {
+							sel.Policy = policy
+						}
+						if interval > 0 {
+							sel.IntervalMin = interval
+						}
+					}
+					preset[key] = sel
+				}
+			}
+			if fromBrewfile != "" {
+				if err := presetFromBrewfile(fromBrewfile, items, preset); err != nil {
+					return err
 				}
 			}
 
-			selected, cancelled, err := tui.RunWatch(items, defaultPolicy, defaultInterval, preset)
-			if err != nil {
-				return err
+			if all {
+				for _, item := range items {
+					key := config.WatchKey(item.Name, item.Type)
+					if _, ok := preset[key]; !ok {
+						preset[key] = tui.Selection{Name: item.Name, Type: item.Type}
+					}
+				}
 			}
-			if cancelled {
-				fmt.Println("Canceled")
-				return nil
+
+			var selected []tui.Selection
+			if yes || !interactive {
+				selected = tui.Preselected(items, defaultPolicy, defaultInterval, preset)
+			} else {
+				if !isTerminal(os.Stdin) {
+					return errors.New("stdin is not a terminal; pass --yes (or --interactive=false) to save without the picker")
+				}
+				var cancelled bool
+				selected, cancelled, err = tui.RunWatch(items, defaultPolicy, defaultInterval, preset, showVersions)
+				if err != nil {
+					return err
+				}
+				if cancelled {
+					fmt.Fprintln(stdout, "Canceled")
+					return nil
+				}
 			}
 			keep := []config.WatchItem{}
 			if typ != "all" {
@@ -182,19 +357,29 @@ func watchCmd() *cobra.Command {
 			newList := make([]config.WatchItem, 0, len(selected))
 			for _, sel := range selected {
 				key := config.WatchKey(sel.Name, sel.Type)
-				addedAt := now
-				if w, ok := existing[key]; ok && !w.AddedAt.IsZero() {
-					addedAt = w.AddedAt
-				}
-				newList = append(newList, config.WatchItem{
-					Name:        sel.Name,
-					Type:        sel.Type,
-					Policy:      sel.Policy,
-					IntervalMin: sel.IntervalMin,
-					AddedAt:     addedAt,
-				})
+				// keep fields the picker does not edit (source, resolved name, ...)
+				item := existing[key]
+				if item.AddedAt.IsZero() {
+					item.AddedAt = now
+				}
+				item.Name = sel.Name
+				item.Type = sel.Type
+				item.Policy = sel.Policy
+				item.IntervalMin = sel.IntervalMin
+				newList = append(newList, item)
+				if _, ok := existing[key]; !ok && sinceVersion {
+					setBaseline(&st, sel.Name, sel.Type, formulae, casks)
+				}
 			}
+			prev := cfg.Watchlist
 			cfg.Watchlist = append(keep, newList...)
+			if dryRun {
+				printWatchlistDiff(prev, cfg.Watchlist, cfg.DefaultPolicy)
+				return nil
+			}
+			if len(newList) == 0 && len(prev) > len(keep) && !allowEmpty {
+				return fmt.Errorf("selection is empty and would remove %d watched packages; rerun with --allow-empty to confirm", len(prev)-len(keep))
+			}
 
 			watched := map[string]bool{}
 			for _, w := range cfg.Watchlist {
@@ -219,24 +404,210 @@ func watchCmd() *cobra.Command {
 			if err := config.SaveState(statePath, st); err != nil {
 				return err
 			}
-			fmt.Printf("Updated watchlist: %d selected\n", len(selected))
+			fmt.Fprintf(stdout, "Updated watchlist: %d selected\n", len(selected))
 			return nil
 		},
 	}
 	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all")
 	cmd.Flags().StringVar(&policy, "policy", "", "auto|notify")
-	cmd.Flags().IntVar(&interval, "interval-min", 0, "1-1440")
+	cmd.Flags().IntVar(&interval, "interval-min", 0, intervalHelp)
+	cmd.Flags().StringVar(&intervalPreset, "interval-preset", "", "hourly|daily|weekly|monthly")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print watchlist changes without saving")
+	cmd.Flags().BoolVar(&allowEmpty, "allow-empty", false, "allow saving an empty selection")
+	cmd.Flags().BoolVar(&sinceVersion, "since-version", false, "baseline newly watched packages at the installed version so only later releases notify or upgrade")
+	cmd.Flags().StringVar(&mergeFrom, "merge-from", "", "merge the watchlist of another config.json instead of opening the picker")
+	cmd.Flags().StringVar(&onConflict, "on-conflict", config.MergeKeepMine, "with --merge-from, for packages in both: keep-mine|keep-theirs|newest")
+	cmd.Flags().BoolVar(&leavesOnly, "leaves-only", false, "only offer formulae installed on request that nothing depends on (brew leaves)")
+	cmd.Flags().BoolVar(&all, "all", false, "preselect every installed package of --type")
+	cmd.Flags().BoolVar(&yes, "yes", false, "save the preselection without opening the picker")
+	cmd.Flags().BoolVar(&interactive, "interactive", true, "open the picker; false is the same as --yes")
+	cmd.Flags().BoolVar(&keepExisting, "keep-existing-settings", true, "keep policy/interval of already watched packages; false applies --policy/--interval-min to them too")
+	cmd.Flags().StringVar(&fromBrewfile, "from-brewfile", "", "preselect the installed brew/cask entries of this Brewfile")
+	cmd.Flags().BoolVar(&showVersions, "show-versions", true, "show installed/latest version columns (toggle with v)")
+	return cmd
+}
+
+func mergeWatchlist(cfg config.Config, st config.State, path, statePath, from, strategy, typ string, sinceVersion, dryRun bool) error {
+	if _, err := os.Stat(from); err != nil {
+		return err
+	}
+	other, err := config.LoadConfig(from)
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+	theirs := []config.WatchItem{}
+	for _, w := range other.Watchlist {
+		if typ == "all" || w.Type == typ {
+			theirs = append(theirs, w)
+		}
+	}
+	existing := map[string]bool{}
+	for _, w := range cfg.Watchlist {
+		existing[config.WatchKey(w.Name, w.Type)] = true
+	}
+	merged, added, updated, err := config.MergeWatchlist(cfg.Watchlist, theirs, strategy)
+	if err != nil {
+		return err
+	}
+	prev := cfg.Watchlist
+	cfg.Watchlist = merged
+	if cfg, err = config.NormalizeConfig(cfg); err != nil {
+		return err
+	}
+	if dryRun {
+		printWatchlistDiff(prev, cfg.Watchlist, cfg.DefaultPolicy)
+		return nil
+	}
+	if sinceVersion && added > 0 {
+		formulae, casks, err := brew.ListInstalled()
+		if err != nil {
+			return err
+		}
+		for _, w := range cfg.Watchlist {
+			if !existing[config.WatchKey(w.Name, w.Type)] {
+				setBaseline(&st, w.Name, w.Type, formulae, casks)
+			}
+		}
+	}
+	if err := config.SaveConfig(path, cfg); err != nil {
+		return err
+	}
+	if err := config.SaveState(statePath, st); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Merged watchlist from %s: %d added, %d updated\n", from, added, updated)
+	return nil
+}
+
+func presetFromBrewfile(path string, items []tui.Item, preset map[string]tui.Selection) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := brew.ParseBrewfile(f)
+	if err != nil {
+		return err
+	}
+	installed := map[string]bool{}
+	for _, item := range items {
+		installed[config.WatchKey(item.Name, item.Type)] = true
+	}
+	missing := []string{}
+	for _, e := range entries {
+		key := config.WatchKey(e.Name, e.Type)
+		if !installed[key] {
+			missing = append(missing, key)
+			continue
+		}
+		if _, ok := preset[key]; !ok {
+			preset[key] = tui.Selection{Name: e.Name, Type: e.Type}
+		}
+	}
+	if len(missing) > 0 && !quiet {
+		fmt.Fprintf(stdout, "skipped (not installed): %s\n", joinNames(missing))
+	}
+	return nil
+}
+
+func dumpCmd() *cobra.Command {
+	var file string
+	cmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Write the watchlist as a Brewfile",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, _, _, _, err := loadConfigState(true)
+			if err != nil {
+				return err
+			}
+			entries := make([]brew.BrewfileEntry, 0, len(cfg.Watchlist))
+			for _, w := range cfg.Watchlist {
+				entries = append(entries, brew.BrewfileEntry{Name: w.Name, Type: w.Type})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+			if file == "" {
+				return brew.WriteBrewfile(stdout, entries)
+			}
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			if err := brew.WriteBrewfile(f, entries); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if !quiet {
+				fmt.Fprintf(stdout, "wrote %d entries to %s\n", len(entries), file)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&file, "file", "", "write to this file instead of stdout")
 	return cmd
 }
 
+func printWatchlistDiff(prev, next []config.WatchItem, defaultPolicy string) {
+	before := map[string]config.WatchItem{}
+	for _, w := range prev {
+		before[config.WatchKey(w.Name, w.Type)] = w
+	}
+	after := map[string]config.WatchItem{}
+	for _, w := range next {
+		after[config.WatchKey(w.Name, w.Type)] = w
+	}
+	effective := func(p string) string {
+		if p == "" {
+			return defaultPolicy
+		}
+		return p
+	}
+	lines := []string{}
+	for key, w := range after {
+		old, ok := before[key]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("+ %s policy=%s interval=%dm", key, effective(w.Policy), w.IntervalMin))
+			continue
+		}
+		changes := []string{}
+		if effective(old.Policy) != effective(w.Policy) {
+			changes = append(changes, fmt.Sprintf("policy=%s->%s", effective(old.Policy), effective(w.Policy)))
+		}
+		if old.IntervalMin != w.IntervalMin {
+			changes = append(changes, fmt.Sprintf("interval=%dm->%dm", old.IntervalMin, w.IntervalMin))
+		}
+		if len(changes) > 0 {
+			lines = append(lines, fmt.Sprintf("~ %s %s", key, strings.Join(changes, " ")))
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			lines = append(lines, "- "+key)
+		}
+	}
+	if len(lines) == 0 {
+		fmt.Fprintln(stdout, "no changes")
+		return
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+	for _, line := range lines {
+		fmt.Fprintln(stdout, line)
+	}
+	fmt.Fprintln(stdout, "dry run: config not saved")
+}
+
 func listCmd() *cobra.Command {
 	var typ string
 	var policy string
+	var outdated bool
+	var asJSON bool
 	cmd := &cobra.Command{
 		Use:   "list",
 		Short: "List watched packages",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, _, _, _, err := loadConfigState(true)
+			cfg, st, _, _, err := loadConfigState(true)
 			if err != nil {
 				return err
 			}
@@ -246,8 +617,16 @@ func listCmd() *cobra.Command {
 			if err := validatePolicy(policy); err != nil {
 				return err
 			}
-			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
-			fmt.Fprintln(tw, "NAME\tTYPE\tPOLICY\tINTERVAL")
+			now := time.Now()
+			entries := []listEntry{}
+			tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+			switch {
+			case asJSON:
+			case outdated:
+				fmt.Fprintln(tw, "NAME\tTYPE\tPOLICY\tINSTALLED\tLATEST")
+			default:
+				fmt.Fprintln(tw, "NAME\tTYPE\tPOLICY\tINTERVAL")
+			}
 			for _, w := range cfg.Watchlist {
 				if typ != "" && typ != "all" && w.Type != typ {
 					continue
@@ -259,84 +638,339 @@ func listCmd() *cobra.Command {
 				if policy != "" && policy != p {
 					continue
 				}
+				pending, order, isPending := pendingVersion(st, w)
+				isOutdated := isPending && (order == vcmp.Older || order == vcmp.Different)
+				if outdated && !isOutdated {
+					continue
+				}
+				if asJSON {
+					entries = append(entries, newListEntry(w, p, pending, st, now))
+					continue
+				}
+				if outdated {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", w.Name, w.Type, p, pending.Installed, pending.Latest)
+					continue
+				}
 				fmt.Fprintf(tw, "%s\t%s\t%s\t%dm\n", w.Name, w.Type, p, w.IntervalMin)
 			}
+			if asJSON {
+				enc := json.NewEncoder(stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(entries)
+			}
 			tw.Flush()
 			return nil
 		},
 	}
 	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all")
 	cmd.Flags().StringVar(&policy, "policy", "", "auto|notify")
+	cmd.Flags().BoolVar(&outdated, "outdated", false, "only show packages the last check found outdated")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "output JSON, including each package's next scheduled check")
 	return cmd
 }
 
+type listEntry struct {
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Policy      string     `json:"policy"`
+	IntervalMin int        `json:"interval_min"`
+	Installed   string     `json:"installed,omitempty"`
+	Latest      string     `json:"latest,omitempty"`
+	NextCheckAt *time.Time `json:"next_check_at,omitempty"`
+	DueNow      bool       `json:"due_now"`
+}
+
+// joins a watch item with its pending versions and schedule from state
+func newListEntry(w config.WatchItem, policy string, pending config.Pending, st config.State, now time.Time) listEntry {
+	e := listEntry{Name: w.Name, Type: w.Type, Policy: policy, IntervalMin: w.IntervalMin, Installed: pending.Installed, Latest: pending.Latest}
+	next, due := check.NextCheck(w, st, now)
+	if !next.IsZero() {
+		e.NextCheckAt = &next
+	}
+	e.DueNow = due
+	return e
+}
+
 func checkCmd() *cobra.Command {
 	var dryRun bool
 	var forceUpdate bool
 	var notifyOnly bool
+	var maxAge time.Duration
+	var resumeGap time.Duration
+	var notifyThreshold int
+	var maxPackages int
+	var catchUp bool
+	var onlyIfStale time.Duration
+	var typ string
+	var fetchTimeout time.Duration
+	var writeState bool
+	var wait time.Duration
+	var greedy bool
+	var validateNames bool
+	var pruneUnknown bool
+	var sortBy string
+	var reportUnchanged bool
+	var preview bool
+	var maxErrorsAbort int
+	var concurrentBrew bool
+	var hostConcurrency map[string]int
+	var retries int
+	var profileTiming bool
+	var notifyOnError bool
+	var onlyAuto bool
+	var onlyNotify bool
+	var showDiff bool
+	var asJSON bool
+	var pretty bool
+	var quietIfUnchanged bool
+	var brewBusyWait time.Duration
+	var onBattery string
+	var networkRequired bool
+	var parallelismAuto bool
+	var reportRemoved bool
+	var deferCasks bool
+	var casksNow bool
+	var preferBrew bool
+	var maxUpgradeSize int
+	var jsonStream bool
+	var persistETags bool
+	var offline bool
+	var installedFrom string
+	var forceCheck bool
+	var gracePeriod time.Duration
+	var healthFile string
+	var installedRefresh bool
+	var onlyChanged bool
 	cmd := &cobra.Command{
 		Use:   "check",
 		Short: "Check updates and upgrade if needed",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, st, path, _, err := loadConfigState(true)
+			cfg, st, path, statePath, err := loadConfigState(true)
 			if err != nil {
 				return err
 			}
+			if err := validateType(typ); err != nil {
+				return err
+			}
+			if sortBy != "name" && sortBy != "type" {
+				return fmt.Errorf("invalid sort: %s", sortBy)
+			}
+			if validateNames || pruneUnknown {
+				return runValidateNames(cfg, path, pruneUnknown)
+			}
+			var listInstalled func() (map[string]string, map[string]string, error)
+			if installedFrom != "" {
+				data, err := os.ReadFile(installedFrom)
+				if err != nil {
+					return err
+				}
+				formulae, casks := brew.ParseInstalledDump(string(data))
+				listInstalled = func() (map[string]string, map[string]string, error) {
+					return formulae, casks, nil
+				}
+				offline = true
+			}
+			if offline {
+				// auditing a copied state must not modify it
+				writeState = false
+			}
+			format := logFormat
+			if format == "" {
+				format = cfg.LogFormat
+			}
+			var logger *slog.Logger
+			if format == applog.FormatJSON {
+				if logger, err = applog.New(stdout, format); err != nil {
+					return err
+				}
+			} else if format != "" && format != applog.FormatText {
+				return fmt.Errorf("invalid log format: %s", format)
+			}
+			if last := st.LastCheckFor(typ); onlyIfStale > 0 && last != nil && time.Since(*last) < onlyIfStale {
+				skipCheck(logger, "recent check")
+				return nil
+			}
 			lockPath := filepath.Join(filepath.Dir(path), "lock")
-			l, err := lock.Acquire(lockPath, 10*time.Minute)
+			l, err := lock.AcquireWait(lockPath, lockTTL, wait)
 			if err != nil {
-				if !quiet {
-					fmt.Println("skip: another check running")
-				}
+				skipCheck(logger, "another check running")
 				return nil
 			}
 			defer l.Release()
 
-			if running, err := brew.HasRunningBrew(); err == nil && running {
-				if !quiet {
-					fmt.Println("skip: brew already running")
+			if (networkRequired || cfg.NetworkRequired) && !offline {
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				err := api.New(api.Options{Proxy: cfg.Proxy}).Reachable(ctx)
+				cancel()
+				if err != nil {
+					skipCheck(logger, "no network")
+					return nil
 				}
+			}
+			if running, err := brew.HasRunningBrew(); err == nil && running && !offline {
+				skipCheck(logger, "brew already running")
 				return nil
 			}
+			// shared with the upgrade's writability check
+			brewPrefix, _ := brew.Prefix()
+			if brewPrefix != "" && !offline {
+				if locked, err := brew.HasActiveLocks(brewPrefix); err == nil && locked {
+					skipCheck(logger, "brew locks held")
+					return nil
+				}
+			}
 
-			if !quiet {
-				fmt.Println("checking...")
+			if onBattery == "" {
+				onBattery = cfg.OnBattery
+			}
+			if err := config.ValidateOnBattery(onBattery); err != nil {
+				return err
+			}
+			if onBattery == "skip" && !notifyOnly && !offline {
+				// version checks are cheap; upgrades wait for AC and stay pending until then
+				if battery, err := power.OnBattery(); err == nil && battery {
+					notifyOnly = true
+					if logger != nil {
+						logger.Info("on battery, upgrades deferred")
+					} else if !quiet && !asJSON && !jsonStream {
+						fmt.Fprintln(stdout, "on battery: upgrades deferred")
+					}
+				}
+			}
+			quietIfUnchanged = quietIfUnchanged || cfg.QuietIfUnchanged
+			if asJSON || jsonStream {
+				// keep --verbose brew output out of the JSON
+				brew.Output = os.Stderr
 			}
-			res, cfg, st, err := check.Run(context.Background(), cfg, st, check.Options{
-				DryRun:      dryRun,
-				ForceUpdate: forceUpdate,
-				NotifyOnly:  notifyOnly,
-				Verbose:     verbose,
+			var onPackage func(check.PackageStatus)
+			if jsonStream {
+				onPackage = streamPackageStatus(json.NewEncoder(stdout))
+			}
+			if !quiet && !asJSON && !jsonStream && logger == nil && !quietIfUnchanged {
+				fmt.Fprintln(stdout, "checking...")
+			}
+			var greedyOverride *bool
+			if cmd.Flags().Changed("greedy") {
+				greedyOverride = &greedy
+			}
+			onlyPolicy := ""
+			if onlyAuto {
+				onlyPolicy = "auto"
+			} else if onlyNotify {
+				onlyPolicy = "notify"
+			}
+			for host, n := range hostConcurrency {
+				if n < 1 || n > 32 {
+					return fmt.Errorf("invalid --concurrency-per-host for %s: %d (must be 1-32)", host, n)
+				}
+			}
+			// finish before the lock can be considered stale
+			ctx, cancel := context.WithTimeout(context.Background(), lockTTL)
+			defer cancel()
+			res, cfg, st, err := check.Run(ctx, cfg, st, check.Options{
+				DryRun:           dryRun,
+				ForceUpdate:      forceUpdate,
+				NotifyOnly:       notifyOnly,
+				Verbose:          verbose,
+				Version:          buildVersion(),
+				MaxAge:           maxAge,
+				ResumeGap:        resumeGap,
+				NotifyThreshold:  notifyThreshold,
+				MaxPackages:      maxPackages,
+				CatchUp:          catchUp,
+				Type:             typ,
+				FetchTimeout:     fetchTimeout,
+				Greedy:           greedyOverride,
+				Preview:          preview,
+				MaxErrorsAbort:   maxErrorsAbort,
+				Serial:           !concurrentBrew,
+				Retries:          retries,
+				NotifyOnError:    notifyOnError,
+				OnlyPolicy:       onlyPolicy,
+				Offline:          offline,
+				ForceCheck:       forceCheck,
+				GracePeriod:      gracePeriod,
+				RefreshInstalled: installedRefresh,
+				OnlyChanged:      onlyChanged,
+				HostConcurrency:  hostConcurrency,
+				RecheckBrew:      cmd.Flags().Changed("abort-on-brew-running-after"),
+				AutoParallelism:  parallelismAuto,
+				NotifyOnRemoved:  reportRemoved,
+				DeferCasks:       deferCasks,
+				CasksNow:         casksNow,
+				PreferBrew:       preferBrew,
+				MaxUpgradeSize:   int64(maxUpgradeSize) << 20,
+				OnPackage:        onPackage,
+				NoETags:          !persistETags,
+				BrewBusyWait:     brewBusyWait,
+				BrewPrefix:       brewPrefix,
+				ListInstalled:    listInstalled,
 			})
 			if err != nil {
 				return err
 			}
-			if err := config.SaveConfig(path, cfg); err != nil {
-				return err
+			if writeState {
+				if err := config.SaveConfig(path, cfg); err != nil {
+					return err
+				}
+				if err := config.SaveState(statePath, st); err != nil {
+					return err
+				}
 			}
-			if err := config.SaveState(config.StatePathFromConfigPath(path), st); err != nil {
-				return err
+			if healthFile == "" {
+				healthFile = cfg.HealthFile
+			}
+			if healthFile != "" {
+				if err := writeHealthFile(healthFile, res); err != nil {
+					return err
+				}
+			}
+			if jsonStream {
+				return json.NewEncoder(stdout).Encode(streamSummary{Type: "summary", checkReport: newCheckReport(res, showDiff)})
+			}
+			if asJSON {
+				// compact by default: one line per run for JSON-lines collectors
+				enc := json.NewEncoder(stdout)
+				if pretty {
+					enc.SetIndent("", "  ")
+				}
+				return enc.Encode(newCheckReport(res, showDiff))
+			}
+			if quietIfUnchanged && len(res.Outdated) == 0 && len(res.Errors) == 0 && len(res.Removed) == 0 {
+				return nil
+			}
+			if logger != nil {
+				logCheckResult(logger, res)
+				return nil
+			}
+			if profileTiming {
+				printTimings(res)
 			}
 			if quiet {
 				return nil
 			}
+			if res.Checked == 0 && res.OverBudget > 0 {
+				fmt.Fprintf(stdout, "api budget exhausted: %d due packages deferred\n", res.OverBudget)
+				return nil
+			}
 			if res.Checked == 0 {
-				fmt.Println("no packages due for check")
+				fmt.Fprintln(stdout, "no packages due for check")
 				return nil
 			}
 			if verbose {
-				fmt.Printf("checked=%d\n", res.Checked)
-				fmt.Printf("checked packages: %s\n", joinNames(res.CheckedNames))
+				fmt.Fprintf(stdout, "checked=%d\n", res.Checked)
+				fmt.Fprintf(stdout, "checked packages: %s\n", joinNames(res.CheckedNames))
 			} else {
-				fmt.Printf("checked=%d: %s\n", res.Checked, joinNames(res.CheckedNames))
+				fmt.Fprintf(stdout, "checked=%d: %s\n", res.Checked, joinNames(res.CheckedNames))
 			}
 			if len(res.Outdated) == 0 {
-				fmt.Println("outdated=0")
+				fmt.Fprintln(stdout, "outdated=0")
 			} else {
 				if verbose {
-					fmt.Printf("outdated=%d\n", len(res.Outdated))
+					fmt.Fprintf(stdout, "outdated=%d\n", len(res.Outdated))
+					sortOutdated(res.Outdated, sortBy)
 					for _, item := range res.Outdated {
-						fmt.Printf("- %s %s -> %s\n", item.Item.Name, item.Installed, item.Latest)
+						fmt.Fprintf(stdout, "- %s %s -> %s\n", item.Item.Name, item.Installed, item.Latest)
 					}
 				} else {
 					names := make([]string, 0, len(res.Outdated))
@@ -344,7 +978,41 @@ func checkCmd() *cobra.Command {
 						names = append(names, item.Item.Name)
 					}
 					sort.Strings(names)
-					fmt.Printf("outdated=%d: %s\n", len(names), joinNames(names))
+					fmt.Fprintf(stdout, "outdated=%d: %s\n", len(names), joinNames(names))
+				}
+			}
+			if len(res.Preview) > 0 {
+				fmt.Fprintf(stdout, "preview=%d: %s\n", len(res.Preview), joinNames(res.Preview))
+			}
+			if len(res.Disputed) > 0 {
+				names := make([]string, 0, len(res.Disputed))
+				for _, item := range res.Disputed {
+					names = append(names, fmt.Sprintf("%s (api %s)", item.Item.Name, item.Latest))
+				}
+				fmt.Fprintf(stdout, "disputed=%d: %s\n", len(names), joinNames(names))
+			}
+			if res.OverBudget > 0 {
+				fmt.Fprintf(stdout, "over_budget=%d: deferred to a later run\n", res.OverBudget)
+			}
+			if len(res.TooLarge) > 0 {
+				fmt.Fprintf(stdout, "deferred (too large)=%d: %s\n", len(res.TooLarge), joinNames(res.TooLarge))
+			}
+			if len(res.Deferred) > 0 {
+				fmt.Fprintf(stdout, "deferred=%d: %s\n", len(res.Deferred), joinNames(res.Deferred))
+			}
+			if showDiff {
+				printDiff(res.Diff)
+			}
+			if verbose && reportUnchanged {
+				unchanged := []check.OutdatedItem{}
+				for _, ps := range res.Statuses {
+					if ps.Err == nil && !ps.Outdated {
+						unchanged = append(unchanged, check.OutdatedItem{Item: ps.Item, Installed: ps.Installed, Latest: ps.Latest})
+					}
+				}
+				sortOutdated(unchanged, sortBy)
+				for _, item := range unchanged {
+					fmt.Fprintf(stdout, "- %s (up to date @ %s)\n", item.Item.Name, item.Installed)
 				}
 			}
 			if len(res.Removed) > 0 {
@@ -353,7 +1021,15 @@ func checkCmd() *cobra.Command {
 					names = append(names, r.Name)
 				}
 				sort.Strings(names)
-				fmt.Printf("removed=%d: %s\n", len(names), joinNames(names))
+				fmt.Fprintf(stdout, "removed=%d: %s\n", len(names), joinNames(names))
+			}
+			if verbose {
+				for _, item := range res.Resolved {
+					fmt.Fprintf(stdout, "resolved: %s %s -> %s\n", item.Type, item.Name, item.ResolvedName)
+				}
+			}
+			for _, w := range res.Warnings {
+				fmt.Fprintf(stdout, "warning: %s\n", w)
 			}
 			return nil
 		},
@@ -361,64 +1037,363 @@ func checkCmd() *cobra.Command {
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "check only")
 	cmd.Flags().BoolVar(&forceUpdate, "force-update", false, "force brew update")
 	cmd.Flags().BoolVar(&notifyOnly, "notify-only", false, "notify only")
+	cmd.Flags().DurationVar(&maxAge, "max-age", 0, "refetch packages whose last fetch is older than this")
+	cmd.Flags().IntVar(&notifyThreshold, "notify-threshold", 0, "only notify when at least N updates are pending")
+	cmd.Flags().IntVar(&maxPackages, "max-packages", 0, "check at most N due packages per run")
+	cmd.Flags().BoolVar(&catchUp, "catch-up", false, "check every overdue package, ignoring --max-packages, the api_requests_per_hour budget and API retry backoff")
+	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all")
+	cmd.Flags().BoolVar(&greedy, "greedy", false, "override include_auto_update_cask for this run")
+	cmd.Flags().IntVar(&maxErrorsAbort, "max-errors-abort", 0, "abort the run after N consecutive network failures")
+	cmd.Flags().IntVar(&retries, "retries", 0, "retry brew update/upgrade N times on download errors (default from config)")
+	cmd.Flags().BoolVar(&onlyChanged, "only-changed-since-last", false, "report and notify only packages whose latest version changed since the previous check; upgrades are unaffected")
+	cmd.Flags().BoolVar(&installedRefresh, "installed-refresh", false, "run brew update before listing installed packages so just-installed or newly tapped ones are seen")
+	cmd.Flags().StringVar(&healthFile, "health-file", "", "write a heartbeat JSON file after every successful check (default from config)")
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", 0, "only auto-upgrade releases that have been latest for this long (default from config)")
+	cmd.Flags().BoolVar(&forceCheck, "force-check", false, "check every watched package, ignoring per-package intervals and --max-packages")
+	cmd.Flags().BoolVar(&offline, "offline", false, "report outdated packages without running brew, notifying or saving state")
+	cmd.Flags().StringVar(&installedFrom, "installed-from", "", "read installed versions from a saved `brew list --versions` dump (implies --offline)")
+	cmd.Flags().BoolVar(&showDiff, "diff", false, "show new versions and outdated/up-to-date changes since the previous check")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "output JSON")
+	cmd.Flags().BoolVar(&pretty, "pretty", false, "indent --json output")
+	cmd.Flags().BoolVar(&jsonStream, "json-stream", false, "print one JSON line per package as it is evaluated, then a summary line")
+	cmd.MarkFlagsMutuallyExclusive("json", "json-stream")
+	cmd.Flags().BoolVar(&persistETags, "persist-etags", true, "send and store ETag/Last-Modified validators; false forces full fetches without touching the cache")
+	cmd.Flags().IntVar(&maxUpgradeSize, "max-upgrade-size", 0, "notify instead of auto-upgrading casks whose download is larger than this many MB (default from config)")
+	cmd.Flags().BoolVar(&preferBrew, "prefer-installed-version-source", false, "also check dry-run and notify-only results against brew outdated (upgrade runs always do); list the rest as disputed")
+	cmd.Flags().BoolVar(&deferCasks, "defer-casks", false, "notify about outdated casks but leave upgrading them to a later run (default from config)")
+	cmd.Flags().BoolVar(&casksNow, "casks-now", false, "upgrade outdated and previously deferred casks even when deferring is configured")
+	cmd.MarkFlagsMutuallyExclusive("defer-casks", "casks-now")
+	cmd.Flags().BoolVar(&reportRemoved, "report-removed-action", false, "send a notification listing packages dropped from the watchlist because they were uninstalled (default from config)")
+	cmd.Flags().BoolVar(&parallelismAuto, "parallelism-auto", false, "size the fetch pool from CPU count and watchlist size, halving it on HTTP 429")
+	cmd.Flags().BoolVar(&networkRequired, "network-required", false, "skip the run without touching state when the API host cannot be resolved (default from config)")
+	cmd.Flags().StringVar(&onBattery, "on-battery", "", "run|skip; skip only notifies while on battery power (default from config)")
+	cmd.Flags().DurationVar(&brewBusyWait, "abort-on-brew-running-after", 0, "re-check for a running brew right before upgrading; wait up to this long for it to exit, then skip upgrades")
+	cmd.Flags().BoolVar(&quietIfUnchanged, "quiet-if-unchanged", false, "print nothing when the run finds no outdated packages, removals or errors (default from config)")
+	cmd.Flags().BoolVar(&onlyAuto, "only-auto", false, "upgrade auto-policy packages only; skip notify-policy packages")
+	cmd.Flags().BoolVar(&onlyNotify, "only-notify", false, "notify for notify-policy packages only; never run brew upgrade")
+	cmd.MarkFlagsMutuallyExclusive("only-auto", "only-notify")
+	cmd.Flags().BoolVar(&notifyOnError, "notify-on-error", false, "send one notification when the run records errors (at most hourly)")
+	cmd.Flags().BoolVar(&profileTiming, "profile-timing", false, "print how long each phase of the check took")
+	cmd.Flags().BoolVar(&concurrentBrew, "concurrent-brew", true, "fetch versions in parallel; false runs every step serially for debugging")
+	cmd.Flags().StringToIntVar(&hostConcurrency, "concurrency-per-host", nil, "max parallel API requests per host, e.g. api.github.com=2,formulae.brew.sh=8 (default from config)")
+	cmd.Flags().BoolVar(&preview, "preview", false, "run brew upgrade --dry-run before upgrading and report what would change")
+	cmd.Flags().BoolVar(&reportUnchanged, "report-unchanged", false, "with --verbose, also list checked packages that are up to date")
+	cmd.Flags().StringVar(&sortBy, "sort", "name", "verbose outdated order: name|type")
+	cmd.Flags().BoolVar(&validateNames, "validate-names", false, "report watched packages that are not installed, then exit")
+	cmd.Flags().BoolVar(&pruneUnknown, "prune-unknown", false, "remove watched packages that are not installed, then exit")
+	cmd.Flags().DurationVar(&wait, "wait", 0, "wait up to this long for a running check to finish")
+	cmd.Flags().BoolVar(&writeState, "write-state", true, "persist config and state changes from this run")
+	cmd.Flags().DurationVar(&fetchTimeout, "fetch-timeout", 0, "timeout per API request (default from config)")
+	cmd.Flags().DurationVar(&onlyIfStale, "check-only-if-stale", 0, "skip the run if the last check is newer than this")
+	cmd.Flags().DurationVar(&resumeGap, "resume-gap", 0, "check everything when the last check is older than this (wake from sleep)")
 	return cmd
 }
 
-func upgradeCmd() *cobra.Command {
-	var typ string
-	var all bool
-	cmd := &cobra.Command{
-		Use:   "upgrade [name...]",
-		Short: "Upgrade watched packages",
-		RunE: func(cmd *cobra.Command, args []string) error {
-			cfg, _, _, _, err := loadConfigState(true)
-			if err != nil {
-				return err
-			}
-			if err := validateType(typ); err != nil {
-				return err
-			}
-			var targets []config.WatchItem
-			if all || len(args) == 0 {
-				targets = cfg.Watchlist
-			} else {
-				m := map[string]bool{}
-				for _, n := range args {
-					m[n] = true
-				}
-				for _, w := range cfg.Watchlist {
-					if m[w.Name] {
-						targets = append(targets, w)
-					}
-				}
+type health struct {
+	LastRun time.Time `json:"last_run"`
+	Checked int       `json:"checked"`
+	Errors  int       `json:"errors"`
+	Version string    `json:"version"`
+}
+
+func writeHealthFile(path string, res check.Result) error {
+	data, err := json.MarshalIndent(health{
+		LastRun: time.Now(),
+		Checked: res.Checked,
+		Errors:  len(res.Errors),
+		Version: buildVersion(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := config.EnsureDir(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func skipCheck(logger *slog.Logger, reason string) {
+	if logger != nil {
+		logger.Info("check skipped", "reason", reason)
+		return
+	}
+	if !quiet {
+		fmt.Fprintln(stdout, "skip: "+reason)
+	}
+}
+
+func logCheckResult(logger *slog.Logger, res check.Result) {
+	for _, e := range res.Errors {
+		logger.Error("check error", "error", e)
+	}
+	for _, w := range res.Warnings {
+		logger.Warn("check warning", "warning", w)
+	}
+	for _, item := range res.Removed {
+		logger.Info("package removed", "name", item.Name, "type", item.Type)
+	}
+	for _, item := range res.Resolved {
+		logger.Info("package resolved", "name", item.Name, "type", item.Type, "resolved_name", item.ResolvedName)
+	}
+	for _, item := range res.Outdated {
+		logger.Info("package outdated", "name", item.Item.Name, "type", item.Item.Type, "installed", item.Installed, "latest", item.Latest)
+	}
+	logger.Info("check finished", "checked", res.Checked, "packages", res.CheckedNames, "outdated", len(res.Outdated), "errors", len(res.Errors))
+}
+
+type checkReport struct {
+	Checked  []string         `json:"checked"`
+	Outdated []packageVersion `json:"outdated"`
+	Removed  []string         `json:"removed"`
+	Preview  []string         `json:"preview,omitempty"`
+	Disputed []packageVersion `json:"disputed,omitempty"`
+	Errors   []string         `json:"errors"`
+	Warnings []string         `json:"warnings,omitempty"`
+	Diff     *diffReport      `json:"diff,omitempty"`
+}
+
+// --json-stream lines: "type" is "package" for each evaluated package and
+// "summary" (the --json report) once the run is done
+type streamPackage struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	PackageType string `json:"package_type"`
+	Installed   string `json:"installed,omitempty"`
+	Latest      string `json:"latest,omitempty"`
+	Outdated    bool   `json:"outdated"`
+	Error       string `json:"error,omitempty"`
+}
+
+type streamSummary struct {
+	Type string `json:"type"`
+	checkReport
+}
+
+func streamPackageStatus(enc *json.Encoder) func(check.PackageStatus) {
+	return func(ps check.PackageStatus) {
+		e := streamPackage{Type: "package", Name: ps.Item.Name, PackageType: ps.Item.Type, Installed: ps.Installed, Latest: ps.Latest, Outdated: ps.Outdated}
+		if ps.Err != nil {
+			e.Error = ps.Err.Error()
+		}
+		_ = enc.Encode(e)
+	}
+}
+
+type packageVersion struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Installed string `json:"installed"`
+	Latest    string `json:"latest"`
+}
+
+type diffReport struct {
+	NewVersions   []versionChange `json:"new_versions"`
+	NewlyOutdated []string        `json:"newly_outdated"`
+	UpToDate      []string        `json:"up_to_date"`
+}
+
+type versionChange struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func newCheckReport(res check.Result, withDiff bool) checkReport {
+	r := checkReport{
+		Checked:  res.CheckedNames,
+		Outdated: []packageVersion{},
+		Removed:  []string{},
+		Preview:  res.Preview,
+		Errors:   res.Errors,
+		Warnings: res.Warnings,
+	}
+	if r.Checked == nil {
+		r.Checked = []string{}
+	}
+	if r.Errors == nil {
+		r.Errors = []string{}
+	}
+	for _, item := range res.Outdated {
+		r.Outdated = append(r.Outdated, packageVersion{Name: item.Item.Name, Type: item.Item.Type, Installed: item.Installed, Latest: item.Latest})
+	}
+	for _, item := range res.Removed {
+		r.Removed = append(r.Removed, item.Name)
+	}
+	for _, item := range res.Disputed {
+		r.Disputed = append(r.Disputed, packageVersion{Name: item.Item.Name, Type: item.Item.Type, Installed: item.Installed, Latest: item.Latest})
+	}
+	if withDiff {
+		d := &diffReport{NewVersions: []versionChange{}, NewlyOutdated: []string{}, UpToDate: []string{}}
+		for _, c := range res.Diff.NewVersions {
+			d.NewVersions = append(d.NewVersions, versionChange{Name: c.Item.Name, Type: c.Item.Type, From: c.From, To: c.To})
+		}
+		for _, item := range res.Diff.NewlyOutdated {
+			d.NewlyOutdated = append(d.NewlyOutdated, item.Name)
+		}
+		for _, item := range res.Diff.UpToDate {
+			d.UpToDate = append(d.UpToDate, item.Name)
+		}
+		r.Diff = d
+	}
+	return r
+}
+
+func printDiff(d check.Diff) {
+	if len(d.NewVersions) == 0 && len(d.NewlyOutdated) == 0 && len(d.UpToDate) == 0 {
+		fmt.Fprintln(stdout, "diff: no changes since last check")
+		return
+	}
+	for _, c := range d.NewVersions {
+		fmt.Fprintf(stdout, "new version: %s %s -> %s\n", c.Item.Name, c.From, c.To)
+	}
+	names := func(items []config.WatchItem) string {
+		out := make([]string, 0, len(items))
+		for _, item := range items {
+			out = append(out, item.Name)
+		}
+		sort.Strings(out)
+		return joinNames(out)
+	}
+	if len(d.NewlyOutdated) > 0 {
+		fmt.Fprintf(stdout, "newly outdated: %s\n", names(d.NewlyOutdated))
+	}
+	if len(d.UpToDate) > 0 {
+		fmt.Fprintf(stdout, "now up to date: %s\n", names(d.UpToDate))
+	}
+}
+
+func printTimings(res check.Result) {
+	tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tELAPSED")
+	for _, t := range res.Timings {
+		fmt.Fprintf(tw, "%s\t%s\n", t.Phase, t.Elapsed.Round(time.Millisecond))
+		if t.Phase == "api fetch" && res.Checked > 0 {
+			ft := res.FetchTiming
+			fmt.Fprintf(tw, "  per package\tmin=%s max=%s avg=%s retries=%d\n", ft.Min.Round(time.Millisecond), ft.Max.Round(time.Millisecond), ft.Avg.Round(time.Millisecond), ft.Retries)
+		}
+	}
+	_ = tw.Flush()
+}
+
+func sortOutdated(items []check.OutdatedItem, by string) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i].Item, items[j].Item
+		if by == "type" && a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+}
+
+func runValidateNames(cfg config.Config, path string, prune bool) error {
+	unknown, err := check.UnknownItems(cfg)
+	if err != nil {
+		return err
+	}
+	if len(unknown) == 0 {
+		if !quiet {
+			fmt.Fprintln(stdout, "all watched packages are installed")
+		}
+		return nil
+	}
+	drop := map[string]bool{}
+	for _, w := range unknown {
+		drop[config.WatchKey(w.Name, w.Type)] = true
+		fmt.Fprintf(stdout, "unknown: %s\n", config.WatchKey(w.Name, w.Type))
+	}
+	if !prune {
+		return nil
+	}
+	kept := make([]config.WatchItem, 0, len(cfg.Watchlist))
+	for _, w := range cfg.Watchlist {
+		if !drop[config.WatchKey(w.Name, w.Type)] {
+			kept = append(kept, w)
+		}
+	}
+	cfg.Watchlist = kept
+	if err := config.SaveConfig(path, cfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "pruned=%d\n", len(unknown))
+	return nil
+}
+
+func upgradeCmd() *cobra.Command {
+	var typ string
+	var all bool
+	var greedy bool
+	var retries int
+	cmd := &cobra.Command{
+		Use:   "upgrade [name...]",
+		Short: "Upgrade watched packages",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, st, _, _, err := loadConfigState(true)
+			if err != nil {
+				return err
+			}
+			if err := validateType(typ); err != nil {
+				return err
+			}
+			var targets []config.WatchItem
+			if all || len(args) == 0 {
+				targets = cfg.Watchlist
+			} else {
+				idx, err := matchWatchItems(cfg.Watchlist, args, typ)
+				if err != nil {
+					return err
+				}
+				for _, i := range idx {
+					targets = append(targets, cfg.Watchlist[i])
+				}
 			}
 			if len(targets) == 0 {
 				if !quiet {
-					fmt.Println("no watched packages matched")
+					fmt.Fprintln(stdout, "no watched packages matched")
 				}
 				return nil
 			}
 			formulae, casks := splitTargets(targets, typ)
 			if len(formulae) == 0 && len(casks) == 0 {
 				if !quiet {
-					fmt.Println("no watched packages matched")
+					fmt.Fprintln(stdout, "no watched packages matched")
 				}
 				return nil
 			}
 			sort.Strings(formulae)
 			sort.Strings(casks)
+			if !cmd.Flags().Changed("greedy") {
+				greedy = cfg.IncludeAutoUpdateCask
+			}
 			if !quiet {
 				total := len(formulae) + len(casks)
-				fmt.Printf("targets=%d\n", total)
+				fmt.Fprintf(stdout, "targets=%d\n", total)
 				if len(formulae) > 0 {
-					fmt.Printf("formula: %s\n", joinNames(formulae))
+					fmt.Fprintf(stdout, "formula: %s\n", joinNames(formulae))
 				}
 				if len(casks) > 0 {
-					fmt.Printf("cask: %s\n", joinNames(casks))
+					fmt.Fprintf(stdout, "cask: %s\n", joinNames(casks))
+				}
+				if verbose {
+					for _, w := range targets {
+						if p, order, ok := pendingVersion(st, w); ok && order == vcmp.Older {
+							fmt.Fprintf(stdout, "- %s %s -> %s (last check)\n", w.Name, p.Installed, p.Latest)
+						}
+					}
 				}
-				fmt.Println("brew update...")
+				fmt.Fprintln(stdout, "brew update...")
 			}
-			if err := brew.Update(verbose); err != nil {
+			if !cmd.Flags().Changed("retries") {
+				retries = cfg.BrewRetries
+			}
+			retry := func(fn func() error) error {
+				return brew.Retry(context.Background(), retries, fn, func(attempt int, err error) {
+					if !quiet {
+						fmt.Fprintf(stdout, "attempt %d failed, retrying: %v\n", attempt, err)
+					}
+				})
+			}
+			if err := retry(func() error { return brew.Update(verbose) }); err != nil {
 				return err
 			}
 			if len(formulae) > 0 {
@@ -429,7 +1404,7 @@ func upgradeCmd() *cobra.Command {
 				}
 			}
 			if len(casks) > 0 {
-				if names, err := brew.OutdatedCask(casks, cfg.IncludeAutoUpdateCask); err == nil {
+				if names, err := brew.OutdatedCask(casks, greedy, cfg.GreedyCasks); err == nil {
 					casks = names
 				} else {
 					return err
@@ -437,62 +1412,241 @@ func upgradeCmd() *cobra.Command {
 			}
 			if len(formulae) == 0 && len(casks) == 0 {
 				if !quiet {
-					fmt.Println("no outdated packages")
+					fmt.Fprintln(stdout, "no outdated packages")
 				}
 				return nil
 			}
 			if !quiet && len(formulae) > 0 {
-				fmt.Printf("outdated formula: %s\n", joinNames(formulae))
-				fmt.Println("brew upgrade formula...")
+				fmt.Fprintf(stdout, "outdated formula: %s\n", joinNames(formulae))
+				fmt.Fprintln(stdout, "brew upgrade formula...")
 			}
-			if err := brew.UpgradeFormula(formulae, verbose); err != nil {
+			if err := retry(func() error { return brew.UpgradeFormula(formulae, verbose) }); err != nil {
 				return err
 			}
 			if !quiet && len(casks) > 0 {
-				fmt.Printf("outdated cask: %s\n", joinNames(casks))
-				if cfg.IncludeAutoUpdateCask {
-					fmt.Println("brew upgrade cask (greedy)...")
+				fmt.Fprintf(stdout, "outdated cask: %s\n", joinNames(casks))
+				if greedy {
+					fmt.Fprintln(stdout, "brew upgrade cask (greedy)...")
 				} else {
-					fmt.Println("brew upgrade cask...")
+					fmt.Fprintln(stdout, "brew upgrade cask...")
 				}
 			}
-			if err := brew.UpgradeCask(casks, cfg.IncludeAutoUpdateCask, verbose); err != nil {
+			if err := retry(func() error { return brew.UpgradeCask(casks, greedy, cfg.GreedyCasks, verbose) }); err != nil {
 				return err
 			}
 			return nil
 		},
 	}
 	cmd.Flags().BoolVar(&all, "all", false, "upgrade all watched packages")
+	cmd.Flags().IntVar(&retries, "retries", 0, "retry brew update/upgrade N times on download errors (default from config)")
+	cmd.Flags().BoolVar(&greedy, "greedy", false, "override include_auto_update_cask for this run")
 	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all")
 	return cmd
 }
 
 func statusCmd() *cobra.Command {
+	var exitCode bool
+	var stale time.Duration
+	var typ string
 	cmd := &cobra.Command{
-		Use:   "status",
+		Use:   "status [name...]",
 		Short: "Show last check status",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			_, st, _, _, err := loadConfigState(true)
+			if err := validateType(typ); err != nil {
+				return err
+			}
+			cfg, st, _, _, err := loadConfigState(true)
 			if err != nil {
 				return err
 			}
-			fmt.Println("last_check:", formatTime(st.LastCheckAt))
-			fmt.Println("last_update:", formatTime(st.LastUpdateAt))
+			if len(args) > 0 {
+				return printPackageStatus(cfg, st, args, typ)
+			}
+			fmt.Fprintln(stdout, "last_check:", formatTime(st.LastCheckAt))
+			fmt.Fprintln(stdout, "last_check_formula:", formatTime(st.LastCheckFormulaAt))
+			fmt.Fprintln(stdout, "last_check_cask:", formatTime(st.LastCheckCaskAt))
+			fmt.Fprintln(stdout, "last_update:", formatTime(st.LastUpdateAt))
+			if dups := check.DuplicateNames(cfg); len(dups) > 0 {
+				fmt.Fprintf(stdout, "warning: watched as both formula and cask: %s", joinNames(dups))
+				if cfg.PreferType == "" {
+					fmt.Fprint(stdout, " (set prefer_type to upgrade only one)")
+				}
+				fmt.Fprintln(stdout)
+			}
 			if len(st.LastErrors) > 0 {
-				fmt.Println("errors:")
+				fmt.Fprintln(stdout, "errors:")
 				for _, e := range st.LastErrors {
-					fmt.Println("-", e)
+					fmt.Fprintln(stdout, "-", e)
+				}
+			}
+			if exitCode {
+				if code := statusExitCode(st, stale, time.Now()); code != 0 {
+					return &exitError{code: code}
 				}
 			}
 			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&exitCode, "exit-code", false, "exit 1 if the last run recorded errors, 2 if the last check is older than --stale")
+	cmd.Flags().DurationVar(&stale, "stale", time.Hour, "with --exit-code, how old the last check may be")
+	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all, for names watched as both")
+	return cmd
+}
+
+// LastErrors spans several runs, so only the last run's count decides
+func statusExitCode(st config.State, stale time.Duration, now time.Time) int {
+	// a stale check means the agent is not running, which hides errors
+	if st.LastCheckAt == nil || now.Sub(*st.LastCheckAt) > stale {
+		return 2
+	}
+	if st.LastRunErrors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printPackageStatus(cfg config.Config, st config.State, names []string, typ string) error {
+	idx, err := matchWatchItems(cfg.Watchlist, names, typ)
+	if err != nil {
+		return err
+	}
+	if len(idx) == 0 {
+		return fmt.Errorf("not watched: %s", joinNames(names))
+	}
+	for _, i := range idx {
+		w := cfg.Watchlist[i]
+		key := config.WatchKey(w.Name, w.Type)
+		latest, ok := st.LastVersions[key]
+		if !ok {
+			fmt.Fprintf(stdout, "%s: latest unknown (not checked yet)\n", key)
+			printHistory(st.History[key])
+			continue
+		}
+		line := fmt.Sprintf("%s: latest %s", key, latest)
+		if seen, err := time.Parse(time.RFC3339, st.VersionFirstSeen[config.VersionKey(key, latest)]); err == nil {
+			line += fmt.Sprintf(", first seen %s ago", formatAge(time.Since(seen)))
+		}
+		if p, order, ok := pendingVersion(st, w); ok {
+			switch order {
+			case vcmp.Older, vcmp.Different:
+				line += fmt.Sprintf(", installed %s (outdated)", p.Installed)
+			case vcmp.Newer:
+				line += fmt.Sprintf(", installed %s (newer than latest)", p.Installed)
+			default:
+				line += fmt.Sprintf(", installed %s", p.Installed)
+			}
+		}
+		fmt.Fprintln(stdout, line)
+		printHistory(st.History[key])
+	}
+	return nil
+}
+
+// newest first
+func printHistory(h []config.Check) {
+	for i := len(h) - 1; i >= 0; i-- {
+		c := h[i]
+		line := fmt.Sprintf("  %s ago: ", formatAge(time.Since(c.At)))
+		switch {
+		case c.Error != "":
+			line += "error: " + c.Error
+		case c.Outdated:
+			line += c.Latest + " (outdated)"
+		default:
+			line += c.Latest
+		}
+		fmt.Fprintln(stdout, line)
+	}
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+type stats struct {
+	Watched     int            `json:"watched"`
+	ByType      map[string]int `json:"by_type"`
+	ByPolicy    map[string]int `json:"by_policy"`
+	Outdated    int            `json:"outdated"`
+	LastCheck   *time.Time     `json:"last_check,omitempty"`
+	LastUpdate  *time.Time     `json:"last_update,omitempty"`
+	ErrorsCount int            `json:"errors"`
+}
+
+func statsCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize watchlist and activity",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, st, _, _, err := loadConfigState(true)
+			if err != nil {
+				return err
+			}
+			s := stats{
+				Watched:     len(cfg.Watchlist),
+				ByType:      map[string]int{"formula": 0, "cask": 0},
+				ByPolicy:    map[string]int{"auto": 0, "notify": 0},
+				LastCheck:   st.LastCheckAt,
+				LastUpdate:  st.LastUpdateAt,
+				ErrorsCount: len(st.LastErrors),
+			}
+			for _, w := range cfg.Watchlist {
+				typ := w.Type
+				if typ == "" {
+					typ = "formula"
+				}
+				s.ByType[typ]++
+				p := w.Policy
+				if p == "" {
+					p = cfg.DefaultPolicy
+				}
+				s.ByPolicy[p]++
+				if _, ok := st.Pending[config.WatchKey(w.Name, w.Type)]; ok {
+					s.Outdated++
+				}
+			}
+			if asJSON {
+				enc := json.NewEncoder(stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(s)
+			}
+			tw := tabwriter.NewWriter(stdout, 2, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "watched\t%d\n", s.Watched)
+			fmt.Fprintf(tw, "formula\t%d\n", s.ByType["formula"])
+			fmt.Fprintf(tw, "cask\t%d\n", s.ByType["cask"])
+			fmt.Fprintf(tw, "auto\t%d\n", s.ByPolicy["auto"])
+			fmt.Fprintf(tw, "notify\t%d\n", s.ByPolicy["notify"])
+			fmt.Fprintf(tw, "outdated\t%d\n", s.Outdated)
+			fmt.Fprintf(tw, "last_check\t%s\n", formatTime(s.LastCheck))
+			fmt.Fprintf(tw, "last_update\t%s\n", formatTime(s.LastUpdate))
+			fmt.Fprintf(tw, "errors\t%d\n", s.ErrorsCount)
+			tw.Flush()
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "output JSON")
 	return cmd
 }
 
 func setCmd() *cobra.Command {
 	var policy string
 	var interval int
+	var intervalPreset string
+	var typ string
+	var sinceVersion bool
+	var source string
+	var repo string
+	var constraint string
+	var verifyRepo bool
 	cmd := &cobra.Command{
 		Use:   "set <name...>",
 		Short: "Update watchlist settings",
@@ -503,36 +1657,458 @@ func setCmd() *cobra.Command {
 			if err := validatePolicy(policy); err != nil {
 				return err
 			}
-			if interval != 0 && (interval < config.MinIntervalMin || interval > config.MaxIntervalMin) {
-				return errors.New("interval-min must be 1-1440")
+			if err := validateType(typ); err != nil {
+				return err
 			}
-			cfg, _, path, _, err := loadConfigState(true)
+			var err error
+			interval, err = resolveInterval(interval, intervalPreset)
 			if err != nil {
 				return err
 			}
-			set := map[string]bool{}
-			for _, n := range args {
-				set[n] = true
+			cfg, st, path, statePath, err := loadConfigState(true)
+			if err != nil {
+				return err
 			}
-			for i := range cfg.Watchlist {
-				if !set[cfg.Watchlist[i].Name] {
-					continue
+			idx, err := matchWatchItems(cfg.Watchlist, args, typ)
+			if err != nil {
+				return err
+			}
+			var formulae, casks map[string]string
+			if sinceVersion {
+				formulae, casks, err = brew.ListInstalled()
+				if err != nil {
+					return err
+				}
+			}
+			if constraint != "" {
+				if _, err := semver.NewConstraint(constraint); err != nil {
+					return fmt.Errorf("invalid constraint: %w", err)
 				}
+			}
+			for _, i := range idx {
 				if policy != "" {
 					cfg.Watchlist[i].Policy = policy
 				}
 				if interval > 0 {
 					cfg.Watchlist[i].IntervalMin = interval
 				}
+				w := &cfg.Watchlist[i]
+				if cmd.Flags().Changed("source") {
+					w.Source = source
+				}
+				if repo != "" {
+					w.Repo = repo
+				}
+				if cmd.Flags().Changed("constraint") {
+					w.Constraint = constraint
+				}
+				if err := config.ValidateSource(w.Source, w.Repo); err != nil {
+					return fmt.Errorf("%s: %w", w.Name, err)
+				}
+				if verifyRepo && w.Source == config.SourceGitHub {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.APIFetchTimeoutSec)*time.Second)
+					err := api.New(api.Options{UserAgent: cfg.UserAgent, Proxy: cfg.Proxy}).CheckRepo(ctx, w.Repo)
+					cancel()
+					if err != nil {
+						return fmt.Errorf("repo %s not reachable: %w", w.Repo, err)
+					}
+				}
+				if sinceVersion {
+					setBaseline(&st, cfg.Watchlist[i].Name, cfg.Watchlist[i].Type, formulae, casks)
+				}
 			}
 			if err := config.SaveConfig(path, cfg); err != nil {
 				return err
 			}
+			if sinceVersion {
+				return config.SaveState(statePath, st)
+			}
 			return nil
 		},
 	}
 	cmd.Flags().StringVar(&policy, "policy", "", "auto|notify")
-	cmd.Flags().IntVar(&interval, "interval-min", 0, "1-1440")
+	cmd.Flags().IntVar(&interval, "interval-min", 0, intervalHelp)
+	cmd.Flags().StringVar(&intervalPreset, "interval-preset", "", "hourly|daily|weekly|monthly")
+	cmd.Flags().StringVar(&typ, "type", "all", "formula|cask|all")
+	cmd.Flags().BoolVar(&sinceVersion, "since-version", false, "only act on releases newer than the currently installed version")
+	cmd.Flags().StringVar(&source, "source", "", "where to look up the latest version: brew|github")
+	cmd.Flags().StringVar(&repo, "repo", "", "GitHub repository as owner/name (with --source github)")
+	cmd.Flags().StringVar(&constraint, "constraint", "", "only consider releases matching this semver constraint, e.g. \"<2.0\"")
+	cmd.Flags().BoolVar(&verifyRepo, "verify-repo", false, "check that the GitHub repository is reachable before saving")
+	return cmd
+}
+
+func setBaseline(st *config.State, name, typ string, formulae, casks map[string]string) {
+	versions := formulae
+	if typ == "cask" {
+		versions = casks
+	}
+	if v, ok := versions[name]; ok {
+		st.Baselines[config.WatchKey(name, typ)] = v
+	}
+}
+
+func migrateStateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate-state",
+		Short: "Rewrite state keys into the type:name format",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, st, _, statePath, err := loadConfigState(true)
+			if err != nil {
+				return err
+			}
+			migrated := check.MigrateState(cfg, &st)
+			if err := config.SaveState(statePath, st); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "migrated=%d\n", len(migrated))
+			for _, m := range migrated {
+				fmt.Fprintln(stdout, "-", m)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "config"}
+	cmd.AddCommand(configEditCmd())
+	return cmd
+}
+
+func configEditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "edit",
+		Short: "Open the config file in $VISUAL or $EDITOR",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			editor := os.Getenv("VISUAL")
+			if editor == "" {
+				editor = os.Getenv("EDITOR")
+			}
+			fields := strings.Fields(editor)
+			if len(fields) == 0 {
+				return errors.New("no editor configured; set $VISUAL or $EDITOR")
+			}
+			editorPath, err := exec.LookPath(fields[0])
+			if err != nil {
+				return err
+			}
+			path, err := config.ResolveConfigPath(cfgPath)
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				data, err = json.MarshalIndent(config.DefaultConfig(), "", "  ")
+			}
+			if err != nil {
+				return err
+			}
+			tmp, err := os.CreateTemp("", config.AppName+"-*.json")
+			if err != nil {
+				return err
+			}
+			tmpPath := tmp.Name()
+			defer os.Remove(tmpPath)
+			_, err = tmp.Write(data)
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			in := bufio.NewReader(os.Stdin)
+			for {
+				ed := exec.Command(editorPath, append(fields[1:], tmpPath)...)
+				ed.Stdin = os.Stdin
+				ed.Stdout = os.Stdout
+				ed.Stderr = os.Stderr
+				if err := ed.Run(); err != nil {
+					return fmt.Errorf("editor failed: %w", err)
+				}
+				cfg, err := parseEditedConfig(tmpPath)
+				if err == nil {
+					if err := config.SaveConfig(path, cfg); err != nil {
+						return err
+					}
+					fmt.Fprintln(stdout, "Saved:", path)
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "invalid config: %v\nreopen editor? [Y/n] ", err)
+				answer, _ := in.ReadString('\n')
+				answer = strings.ToLower(strings.TrimSpace(answer))
+				if answer != "" && answer != "y" && answer != "yes" {
+					return errors.New("edit discarded, config unchanged")
+				}
+			}
+		},
+	}
+	return cmd
+}
+
+func parseEditedConfig(path string) (config.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config.Config{}, err
+	}
+	cfg := config.DefaultConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return config.NormalizeConfig(cfg)
+}
+
+func doctorCmd() *cobra.Command {
+	var fix bool
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose common setup problems",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems := 0
+			report := func(ok bool, msg string) {
+				if ok {
+					fmt.Fprintln(stdout, "ok:", msg)
+					return
+				}
+				problems++
+				fmt.Fprintln(stdout, "problem:", msg)
+			}
+			// with --fix, each repair is offered right after its problem is reported
+			repair := func(action string, fn func() error) {
+				if !fix {
+					return
+				}
+				if !yes && !confirm("fix: "+action+"?") {
+					fmt.Fprintln(stdout, "skipped:", action)
+					return
+				}
+				if err := fn(); err != nil {
+					fmt.Fprintf(stdout, "fix failed: %s: %v\n", action, err)
+					return
+				}
+				problems--
+				fmt.Fprintln(stdout, "fixed:", action)
+			}
+			if _, err := brew.FindBrew(); err != nil {
+				report(false, "brew not found in PATH")
+				return errors.New("1 problem found")
+			}
+			report(true, "brew found")
+			path, err := config.ResolveConfigPath(cfgPath)
+			if err != nil {
+				return err
+			}
+			stPath := config.ResolveStatePath(statePath, path)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				report(false, "config not found: "+path)
+				repair("create default config and state", func() error {
+					if err := config.SaveConfig(path, config.DefaultConfig()); err != nil {
+						return err
+					}
+					return config.SaveState(stPath, config.DefaultState())
+				})
+			} else if _, err := os.Stat(stPath); os.IsNotExist(err) {
+				report(false, "state not found: "+stPath)
+				repair("create empty state", func() error {
+					return config.SaveState(stPath, config.DefaultState())
+				})
+			}
+			cfg, _, _, _, err := loadConfigState(true)
+			if err != nil {
+				report(false, fmt.Sprintf("config: %v", err))
+			} else {
+				report(true, "config loads")
+				if loaded, err := launchd.Status(); err == nil && !loaded {
+					report(false, "launchd agent not loaded")
+					repair("load the launchd agent", func() error {
+						if err := launchd.Load(); !os.IsNotExist(err) {
+							return err
+						}
+						bin, err := os.Executable()
+						if err != nil {
+							return err
+						}
+						var extraArgs []string
+						if stPath != config.StatePathFromConfigPath(path) {
+							extraArgs = append(extraArgs, "--state", stPath)
+						}
+						plist, err := launchd.Install(bin, path, false, extraArgs)
+						if err == nil {
+							fmt.Fprintln(stdout, "installed:", plist)
+						}
+						return err
+					})
+				}
+			}
+			lockPath := filepath.Join(filepath.Dir(path), "lock")
+			if stale, err := lock.Stale(lockPath, lockTTL); err == nil && stale {
+				report(false, "stale lock: "+lockPath)
+				repair("remove the stale lock", func() error {
+					return os.Remove(lockPath)
+				})
+			}
+			if len(cfg.GreedyCasks) > 0 {
+				if _, casks, err := brew.ListInstalled(); err == nil {
+					unknown := []string{}
+					for _, name := range cfg.GreedyCasks {
+						if _, ok := casks[name]; !ok {
+							unknown = append(unknown, name)
+						}
+					}
+					if len(unknown) > 0 {
+						report(false, fmt.Sprintf("greedy_casks not installed as casks: %s", joinNames(unknown)))
+					} else {
+						report(true, "greedy_casks installed")
+					}
+				}
+			}
+			prefix, err := brew.Prefix()
+			dirs := []string{}
+			if err == nil {
+				dirs = brew.UnwritableDirs(prefix)
+			}
+			switch {
+			case err != nil:
+				report(false, fmt.Sprintf("brew --prefix: %v", err))
+			case len(dirs) > 0:
+				report(false, fmt.Sprintf("Homebrew directories not writable by current user: %s", joinNames(dirs)))
+				fmt.Fprintln(stdout, "  upgrades will fail; run brew-updater as the Homebrew owner or fix ownership with: sudo chown -R $(whoami) "+strings.Join(dirs, " "))
+			default:
+				report(true, "Homebrew directories writable")
+			}
+			if problems > 0 {
+				return fmt.Errorf("%d problem(s) found", problems)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&fix, "fix", false, "offer to repair what can be fixed automatically")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "with --fix, repair without asking")
+	return cmd
+}
+
+func uninstallCmd() *cobra.Command {
+	var purge bool
+	var yes bool
+	cmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the launchd agent and, with --purge, config, state and logs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := config.ResolveConfigPath(cfgPath)
+			if err != nil {
+				return err
+			}
+			plist, err := launchd.PlistPath()
+			if err != nil {
+				return err
+			}
+			files := []string{}
+			if purge {
+				files = append(files, path, config.ResolveStatePath(statePath, path), filepath.Join(filepath.Dir(path), "lock"))
+				if logPath, err := launchd.LogsPath(); err == nil {
+					files = append(files, logPath)
+				}
+			}
+			if !yes {
+				fmt.Fprintln(stdout, "This will remove:")
+				for _, f := range append([]string{plist}, files...) {
+					fmt.Fprintln(stdout, "-", f)
+				}
+				if !confirm("continue?") {
+					return errors.New("aborted")
+				}
+			}
+			if err := launchd.Uninstall(); err == nil {
+				fmt.Fprintln(stdout, "removed:", plist)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			for _, f := range files {
+				err := os.Remove(f)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(stdout, "removed:", f)
+			}
+			if purge {
+				// only succeeds once the directory is empty
+				_ = os.Remove(filepath.Dir(path))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&purge, "purge", false, "also remove config, state and log files")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "do not ask for confirmation")
+	return cmd
+}
+
+func debugCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "debug", Short: "Debugging helpers", Hidden: true}
+	cmd.AddCommand(debugCheckCmd())
+	return cmd
+}
+
+func debugCheckCmd() *cobra.Command {
+	var simulate []string
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Run a check that treats packages as outdated without fetching; state is not saved",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(simulate) == 0 {
+				return errors.New("--simulate-outdated is required")
+			}
+			versions := map[string]string{}
+			for _, s := range simulate {
+				name, version, ok := strings.Cut(s, "=")
+				if !ok || name == "" || version == "" {
+					return fmt.Errorf("invalid --simulate-outdated %q, want name=version", s)
+				}
+				versions[name] = version
+			}
+			cfg, st, path, _, err := loadConfigState(true)
+			if err != nil {
+				return err
+			}
+			// without --dry-run this upgrades; never overlap a scheduled check
+			l, err := lock.Acquire(filepath.Join(filepath.Dir(path), "lock"), lockTTL)
+			if err != nil {
+				if errors.Is(err, lock.ErrLocked) {
+					return errors.New("another check is running, try again later")
+				}
+				return err
+			}
+			defer l.Release()
+			ctx, cancel := context.WithTimeout(context.Background(), lockTTL)
+			defer cancel()
+			res, _, _, err := check.Run(ctx, cfg, st, check.Options{
+				DryRun:   dryRun,
+				Verbose:  verbose,
+				Version:  buildVersion(),
+				Simulate: versions,
+			})
+			if err != nil {
+				return err
+			}
+			if res.Checked == 0 {
+				return errors.New("no watched package matched --simulate-outdated")
+			}
+			for _, item := range res.Outdated {
+				fmt.Fprintf(stdout, "- %s %s -> %s\n", item.Item.Name, item.Installed, item.Latest)
+			}
+			for _, e := range res.Errors {
+				fmt.Fprintln(stdout, "error:", e)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&simulate, "simulate-outdated", nil, "name=version to report as the latest version (repeatable)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "notify only, do not upgrade")
 	return cmd
 }
 
@@ -547,6 +2123,8 @@ func launchdCmd() *cobra.Command {
 func launchdInstallCmd() *cobra.Command {
 	var interval int
 	var startNow bool
+	var checkOnWake bool
+	var respectIntervals bool
 	cmd := &cobra.Command{
 		Use:   "install",
 		Short: "Install launchd agent",
@@ -554,7 +2132,7 @@ func launchdInstallCmd() *cobra.Command {
 			if interval != 0 && interval != 60 {
 				return errors.New("interval-sec fixed to 60")
 			}
-			_, _, path, _, err := loadConfigState(true)
+			_, _, path, stPath, err := loadConfigState(true)
 			if err != nil {
 				return err
 			}
@@ -562,16 +2140,28 @@ func launchdInstallCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			plist, err := launchd.Install(bin, path, startNow)
+			var extraArgs []string
+			if stPath != config.StatePathFromConfigPath(path) {
+				extraArgs = append(extraArgs, "--state", stPath)
+			}
+			if checkOnWake {
+				extraArgs = append(extraArgs, "--resume-gap", launchd.WakeResumeGap)
+			}
+			if !respectIntervals {
+				extraArgs = append(extraArgs, "--force-check")
+			}
+			plist, err := launchd.Install(bin, path, startNow, extraArgs)
 			if err != nil {
 				return err
 			}
-			fmt.Println("installed:", plist)
+			fmt.Fprintln(stdout, "installed:", plist)
 			return nil
 		},
 	}
 	cmd.Flags().IntVar(&interval, "interval-sec", 60, "fixed to 60")
 	cmd.Flags().BoolVar(&startNow, "start-now", false, "run immediately")
+	cmd.Flags().BoolVar(&respectIntervals, "check-interval-respect", true, "honor per-package intervals; false checks every package on every tick")
+	cmd.Flags().BoolVar(&checkOnWake, "check-on-wake", false, "check all packages on the first tick after sleep")
 	return cmd
 }
 
@@ -583,7 +2173,7 @@ func launchdUninstallCmd() *cobra.Command {
 			if err := launchd.Uninstall(); err != nil {
 				return err
 			}
-			fmt.Println("uninstalled")
+			fmt.Fprintln(stdout, "uninstalled")
 			return nil
 		},
 	}
@@ -599,13 +2189,152 @@ func launchdStatusCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			fmt.Println("running:", on)
+			fmt.Fprintln(stdout, "running:", on)
+			if !verbose {
+				return nil
+			}
+			info, err := launchd.Describe()
+			if err != nil {
+				return err
+			}
+			pid := "-"
+			if info.PID > 0 {
+				pid = strconv.Itoa(info.PID)
+			}
+			exit := info.LastExitStatus
+			if exit == "" {
+				exit = "-"
+			}
+			fmt.Fprintln(stdout, "loaded:", info.Loaded)
+			fmt.Fprintln(stdout, "pid:", pid)
+			fmt.Fprintln(stdout, "last_exit:", exit)
+			if info.StartInterval > 0 {
+				fmt.Fprintln(stdout, "interval:", info.StartInterval)
+			} else {
+				fmt.Fprintln(stdout, "interval: -")
+			}
+			// quiet runs and -o leave the log untouched; state is written every run
+			var lastRun *time.Time
+			if _, st, _, _, err := loadConfigState(false); err == nil {
+				lastRun = st.LastCheckAt
+			}
+			fmt.Fprintln(stdout, "last_run:", formatTime(lastRun))
+			if info.Loaded && info.StartInterval > 0 && lastRun != nil {
+				next := lastRun.Add(info.StartInterval)
+				if next.Before(time.Now()) {
+					// missed ticks (sleep) run as soon as launchd gets to it
+					next = time.Now()
+				}
+				fmt.Fprintln(stdout, "next_run: ~"+next.Format(time.RFC3339))
+			}
+			fmt.Fprintln(stdout, "plist:", info.PlistPath)
+			fmt.Fprintln(stdout, "log:", info.LogPath)
 			return nil
 		},
 	}
 	return cmd
 }
 
+func selfUpgradeCmd() *cobra.Command {
+	var tap string
+	cmd := &cobra.Command{
+		Use:   "self-upgrade",
+		Short: "Upgrade brew-updater itself via Homebrew",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bin, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			if resolved, err := filepath.EvalSymlinks(bin); err == nil {
+				bin = resolved
+			}
+			name := tapFormula(tap)
+			if !strings.Contains(bin, "/Cellar/"+config.AppName+"/") {
+				fmt.Fprintf(stdout, "%s is not managed by Homebrew: %s\n", config.AppName, bin)
+				fmt.Fprintln(stdout, "install with: brew install "+name)
+				return nil
+			}
+			if !quiet {
+				fmt.Fprintln(stdout, "brew update...")
+			}
+			if err := brew.Update(verbose); err != nil {
+				return err
+			}
+			if !quiet {
+				fmt.Fprintln(stdout, "brew upgrade "+name+"...")
+			}
+			if err := brew.UpgradeFormula([]string{name}, verbose); err != nil {
+				return err
+			}
+			if on, err := launchd.Status(); err == nil && on {
+				fmt.Fprintln(stdout, "launchd agent is loaded; run 'brew-updater launchd install' to restart it on the new binary")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&tap, "tap", "samzong/tap", "Homebrew tap providing brew-updater")
+	return cmd
+}
+
+// an empty tap means homebrew-core
+func tapFormula(tap string) string {
+	if tap == "" {
+		return config.AppName
+	}
+	return tap + "/" + config.AppName
+}
+
+func matchWatchItems(items []config.WatchItem, names []string, typ string) ([]int, error) {
+	idx := []int{}
+	for _, name := range names {
+		matches := []int{}
+		for i, w := range items {
+			if w.Name != name {
+				continue
+			}
+			if typ != "" && typ != "all" && w.Type != typ {
+				continue
+			}
+			matches = append(matches, i)
+		}
+		if len(matches) > 1 {
+			keys := make([]string, 0, len(matches))
+			for _, i := range matches {
+				keys = append(keys, config.WatchKey(items[i].Name, items[i].Type))
+			}
+			return nil, fmt.Errorf("ambiguous name %s: %s; use --type", name, joinNames(keys))
+		}
+		idx = append(idx, matches...)
+	}
+	return idx, nil
+}
+
+var intervalHelp = fmt.Sprintf("%d-%d", config.MinIntervalMin, config.MaxIntervalMin)
+
+func resolveInterval(interval int, preset string) (int, error) {
+	if preset != "" {
+		return config.ParseInterval(preset)
+	}
+	if interval != 0 && config.ValidateInterval(interval) != nil {
+		return 0, fmt.Errorf("interval-min must be %s", intervalHelp)
+	}
+	return interval, nil
+}
+
+// the last check's pending entry for w, compared against the newest known
+// latest version
+func pendingVersion(st config.State, w config.WatchItem) (config.Pending, vcmp.Ordering, bool) {
+	key := config.WatchKey(w.Name, w.Type)
+	p, ok := st.Pending[key]
+	if !ok {
+		return p, vcmp.Equal, false
+	}
+	if latest, ok := st.LastVersions[key]; ok && latest != "" {
+		p.Latest = latest
+	}
+	return p, vcmp.Compare(p.Installed, p.Latest, vcmp.Options{}), true
+}
+
 func splitTargets(items []config.WatchItem, typ string) ([]string, []string) {
 	formulae := []string{}
 	casks := []string{}
@@ -646,12 +2375,12 @@ func loadConfigState(require bool) (config.Config, config.State, string, string,
 	if err != nil {
 		return config.Config{}, config.State{}, "", "", err
 	}
-	statePath := config.StatePathFromConfigPath(path)
-	st, err := config.LoadState(statePath)
+	stPath := config.ResolveStatePath(statePath, path)
+	st, err := config.LoadState(stPath)
 	if err != nil {
 		return config.Config{}, config.State{}, "", "", err
 	}
-	return cfg, st, path, statePath, nil
+	return cfg, st, path, stPath, nil
 }
 
 func validatePolicy(policy string) error {
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samzong/brew-updater/internal/config"
+)
+
+func TestMatchWatchItemsDualInstall(t *testing.T) {
+	items := []config.WatchItem{
+		{Name: "docker", Type: "formula"},
+		{Name: "docker", Type: "cask"},
+		{Name: "git", Type: "formula"},
+	}
+	tests := []struct {
+		name    string
+		names   []string
+		typ     string
+		want    []int
+		wantErr string
+	}{
+		{"bare ambiguous name", []string{"docker"}, "all", nil, "ambiguous name docker: formula:docker, cask:docker"},
+		{"empty type is ambiguous too", []string{"docker"}, "", nil, "ambiguous"},
+		{"formula", []string{"docker"}, "formula", []int{0}, ""},
+		{"cask", []string{"docker"}, "cask", []int{1}, ""},
+		{"unique name", []string{"git"}, "all", []int{2}, ""},
+		{"type filters out", []string{"git"}, "cask", []int{}, ""},
+		{"several names", []string{"git", "docker"}, "formula", []int{2, 0}, ""},
+		{"one ambiguous among several", []string{"git", "docker"}, "all", nil, "ambiguous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchWatchItems(items, tt.names, tt.typ)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewListEntry(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	st := config.DefaultState()
+	st.NextCheckAt["formula:git"] = now.Add(30 * time.Minute).Format(time.RFC3339)
+	st.NextCheckAt["cask:firefox"] = now.Add(-time.Minute).Format(time.RFC3339)
+	// legacy state keyed by bare name
+	st.NextCheckAt["node"] = now.Add(10 * time.Minute).Format(time.RFC3339)
+	st.Pending["cask:firefox"] = config.Pending{Installed: "124.0", Latest: "125.0"}
+
+	tests := []struct {
+		item      config.WatchItem
+		wantNext  time.Duration
+		wantDue   bool
+		installed string
+	}{
+		{config.WatchItem{Name: "git", Type: "formula", IntervalMin: 60}, 30 * time.Minute, false, ""},
+		{config.WatchItem{Name: "firefox", Type: "cask", IntervalMin: 60}, -time.Minute, true, "124.0"},
+		{config.WatchItem{Name: "node", Type: "formula", IntervalMin: 60}, 10 * time.Minute, false, ""},
+	}
+	for _, tt := range tests {
+		key := config.WatchKey(tt.item.Name, tt.item.Type)
+		e := newListEntry(tt.item, "auto", st.Pending[key], st, now)
+		if e.NextCheckAt == nil || !e.NextCheckAt.Equal(now.Add(tt.wantNext)) {
+			t.Errorf("%s: next_check_at = %v, want now%+v", key, e.NextCheckAt, tt.wantNext)
+		}
+		if e.DueNow != tt.wantDue {
+			t.Errorf("%s: due_now = %v, want %v", key, e.DueNow, tt.wantDue)
+		}
+		if e.Installed != tt.installed {
+			t.Errorf("%s: installed = %q, want %q", key, e.Installed, tt.installed)
+		}
+	}
+
+	// never checked: no next time, due right away
+	e := newListEntry(config.WatchItem{Name: "new", Type: "formula", IntervalMin: 60}, "auto", config.Pending{}, st, now)
+	if e.NextCheckAt != nil || !e.DueNow {
+		t.Errorf("unscheduled entry = %+v, want due with no next_check_at", e)
+	}
+}
+
+func TestStatusExitCode(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	recent := now.Add(-10 * time.Minute)
+	old := now.Add(-2 * time.Hour)
+
+	failed := config.DefaultState()
+	failed.LastCheckAt = &recent
+	failed.LastErrors = []string{"git: api status 503"}
+	failed.LastRunErrors = 1
+
+	// the next run was clean; the 503 stays in the history only
+	clean := failed
+	clean.LastRunErrors = 0
+
+	staleRun := clean
+	staleRun.LastCheckAt = &old
+
+	tests := []struct {
+		name string
+		st   config.State
+		want int
+	}{
+		{"failed run", failed, 1},
+		{"clean run after a failed one", clean, 0},
+		{"stale check", staleRun, 2},
+		{"never checked", config.DefaultState(), 2},
+	}
+	for _, tt := range tests {
+		if got := statusExitCode(tt.st, time.Hour, now); got != tt.want {
+			t.Errorf("%s: exit code = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPackageStatusDualInstall(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Watchlist = []config.WatchItem{
+		{Name: "docker", Type: "formula"},
+		{Name: "docker", Type: "cask"},
+	}
+	st := config.DefaultState()
+	st.LastVersions["formula:docker"] = "27.0.3"
+	st.LastVersions["cask:docker"] = "4.32.0"
+
+	var out strings.Builder
+	stdout = &out
+	t.Cleanup(func() { stdout = os.Stdout })
+
+	if err := printPackageStatus(cfg, st, []string{"docker"}, "all"); err == nil || !strings.Contains(err.Error(), "use --type") {
+		t.Fatalf("err = %v, want an ambiguous name error", err)
+	}
+	for _, typ := range []string{"formula", "cask"} {
+		out.Reset()
+		if err := printPackageStatus(cfg, st, []string{"docker"}, typ); err != nil {
+			t.Fatalf("--type %s: %v", typ, err)
+		}
+		want := typ + ":docker: latest " + st.LastVersions[typ+":docker"]
+		if got := out.String(); !strings.HasPrefix(got, want) {
+			t.Errorf("--type %s: output = %q, want %q", typ, got, want)
+		}
+	}
+}
+
+func TestTapFormula(t *testing.T) {
+	tests := map[string]string{
+		"samzong/tap": "samzong/tap/brew-updater",
+		"":            "brew-updater",
+	}
+	for tap, want := range tests {
+		if got := tapFormula(tap); got != want {
+			t.Errorf("tapFormula(%q) = %q, want %q", tap, got, want)
+		}
+	}
+}
@@ -1,75 +1,307 @@
 package api
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
+
 	"github.com/samzong/brew-updater/internal/config"
 )
 
 const (
-	baseURL = "https://formulae.brew.sh/api"
+	baseURL   = "https://formulae.brew.sh/api"
+	githubURL = "https://api.github.com"
 )
 
 type Client struct {
 	httpClient *http.Client
+	userAgent  string
+	retry      RetryPolicy
+	proxy      func(*http.Request) (*url.URL, error)
+}
+
+// RetryPolicy controls how transient failures (429, 5xx, dropped
+// connections) are retried; zero fields take the DefaultRetry values.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetry = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// RetryError is returned once every attempt of a retryable request failed.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%v (after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retries reports how many times a failed request was retried.
+func Retries(err error) int {
+	var re *RetryError
+	if errors.As(err, &re) {
+		return re.Attempts - 1
+	}
+	return 0
+}
+
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("api status %d", e.Code)
+}
+
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+func IsRateLimited(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusTooManyRequests
+}
+
+func IsNetworkError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+type Options struct {
+	UserAgent string
+	Retry     RetryPolicy
+	// proxy URL used instead of HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	Proxy string
 }
 
 type Latest struct {
-	Version string
-	Scheme  int
+	Version  string
+	Scheme   int
+	Homepage string
+	URL      string
+	// transient failures retried before this response
+	Retries int
 }
 
-func New() *Client {
+func New(opts Options) *Client {
+	ua := opts.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent("dev")
+	}
+	retry := opts.Retry
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = DefaultRetry.MaxAttempts
+	}
+	if retry.BaseDelay <= 0 {
+		retry.BaseDelay = DefaultRetry.BaseDelay
+	}
+	if retry.MaxDelay <= 0 {
+		retry.MaxDelay = DefaultRetry.MaxDelay
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.Proxy != "" {
+		// validated at config load
+		if u, err := url.Parse(opts.Proxy); err == nil {
+			transport.Proxy = http.ProxyURL(u)
+		}
+	}
 	return &Client{
-		httpClient: &http.Client{Timeout: 10 * time.Second},
+		httpClient: &http.Client{Transport: transport},
+		userAgent:  ua,
+		retry:      retry,
+		proxy:      transport.Proxy,
 	}
 }
 
-func (c *Client) FetchLatest(ctx context.Context, item config.WatchItem, etag string) (Latest, string, bool, error) {
-	url := buildURL(item)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do sends the request built by newReq, retrying transient failures with
+// jittered exponential backoff. A non-retryable status is returned as an
+// open response for the caller to handle.
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, int, error) {
+	delay := c.retry.BaseDelay
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, attempt - 1, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err == nil && !retryable(resp.StatusCode) {
+			return resp, attempt - 1, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = &StatusError{Code: resp.StatusCode}
+		} else if ctx.Err() != nil || !IsNetworkError(err) {
+			return nil, attempt - 1, err
+		}
+		if attempt >= c.retry.MaxAttempts {
+			if attempt > 1 {
+				err = &RetryError{Attempts: attempt, Err: err}
+			}
+			return nil, attempt - 1, err
+		}
+		// half fixed, half random so parallel workers don't retry in lockstep
+		wait := delay/2 + rand.N(delay/2+1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, attempt - 1, &RetryError{Attempts: attempt, Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, attempt - 1, &RetryError{Attempts: attempt, Err: err}
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, c.retry.MaxDelay)
+	}
+}
+
+// Reachable does a quick check to detect being offline: a DNS lookup of the
+// API host, or a connection to the proxy when one applies, since on
+// proxy-only networks only the proxy can resolve external names.
+func (c *Client) Reachable(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
 	if err != nil {
-		return Latest{}, "", false, err
+		return err
 	}
-	if etag != "" {
-		req.Header.Set("If-None-Match", etag)
+	proxy, err := c.proxy(req)
+	if err != nil {
+		return err
 	}
+	if proxy != nil {
+		port := proxy.Port()
+		if port == "" {
+			port = "80"
+			if proxy.Scheme == "https" {
+				port = "443"
+			}
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	_, err = net.DefaultResolver.LookupHost(ctx, req.URL.Hostname())
+	return err
+}
 
-	resp, err := c.httpClient.Do(req)
+func DefaultUserAgent(version string) string {
+	return config.AppName + "/" + version
+}
+
+func (c *Client) FetchLatest(ctx context.Context, item config.WatchItem, cached Validators) (Latest, Validators, bool, error) {
+	url := buildURL(item)
+	resp, retries, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		if item.Source == config.SourceGitHub {
+			req.Header.Set("Accept", "application/vnd.github+json")
+		}
+		// set explicitly so custom transports still get compressed responses;
+		// this turns off net/http's transparent decoding, handled below
+		req.Header.Set("Accept-Encoding", "gzip")
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return Latest{}, "", false, err
+		return Latest{}, Validators{}, false, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotModified {
-		return Latest{}, etag, true, nil
+		return Latest{Retries: retries}, cached, true, nil
 	}
 	if resp.StatusCode != http.StatusOK {
-		return Latest{}, "", false, fmt.Errorf("api status %d", resp.StatusCode)
+		return Latest{}, Validators{}, false, &StatusError{Code: resp.StatusCode}
 	}
-	body, err := io.ReadAll(resp.Body)
+	var reader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return Latest{}, Validators{}, false, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	body, err := io.ReadAll(reader)
 	if err != nil {
-		return Latest{}, "", false, err
+		return Latest{}, Validators{}, false, err
+	}
+	validators := Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
 	}
-	newETag := resp.Header.Get("ETag")
 
-	latest, err := parseLatest(item.Type, body)
+	latest, err := parseLatest(item, body)
 	if err != nil {
-		return Latest{}, "", false, err
+		return Latest{}, Validators{}, false, err
 	}
-	return latest, newETag, false, nil
+	latest.Retries = retries
+	return latest, validators, false, nil
 }
 
 func buildURL(item config.WatchItem) string {
+	if item.Source == config.SourceGitHub {
+		return fmt.Sprintf("%s/repos/%s/releases?per_page=30", githubURL, item.Repo)
+	}
+	name := item.Name
+	if item.ResolvedName != "" {
+		name = item.ResolvedName
+	}
 	if item.Type == "cask" {
-		return fmt.Sprintf("%s/cask/%s.json", baseURL, item.Name)
+		return fmt.Sprintf("%s/cask/%s.json", baseURL, name)
 	}
-	return fmt.Sprintf("%s/formula/%s.json", baseURL, item.Name)
+	return fmt.Sprintf("%s/formula/%s.json", baseURL, name)
 }
 
 func URLFor(item config.WatchItem) string {
@@ -77,6 +309,7 @@ func URLFor(item config.WatchItem) string {
 }
 
 type formulaResp struct {
+	Homepage      string `json:"homepage"`
 	Version       string `json:"version"`
 	Revision      int    `json:"revision"`
 	VersionScheme int    `json:"version_scheme"`
@@ -86,17 +319,192 @@ type formulaResp struct {
 }
 
 type caskResp struct {
-	Version string `json:"version"`
+	Version    string `json:"version"`
+	Homepage   string `json:"homepage"`
+	URL        string `json:"url"`
+	Variations map[string]struct {
+		Version string `json:"version"`
+	} `json:"variations"`
+}
+
+// multi-arch casks may carry the version only per OS variation, keyed
+// "arm64_<os>" on Apple silicon and "<os>" on Intel; the running release
+// wins, then the newest one brew knows
+func (c caskResp) version(arch, release string) string {
+	if c.Version != "" {
+		return c.Version
+	}
+	prefix := ""
+	if arch == "arm64" {
+		prefix = "arm64_"
+	}
+	order := macOSReleases
+	if release != "" {
+		order = append([]string{release}, macOSReleases...)
+	}
+	for _, r := range order {
+		if v := c.Variations[prefix+r].Version; v != "" {
+			return v
+		}
+	}
+	// codenames newer than this list, in a stable order
+	keys := make([]string, 0, len(c.Variations))
+	for k := range c.Variations {
+		if strings.HasPrefix(k, "arm64_") == (arch == "arm64") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := c.Variations[k].Version; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// brew's variation names, newest first
+var macOSReleases = []string{"tahoe", "sequoia", "sonoma", "ventura", "monterey", "big_sur", "catalina", "mojave", "high_sierra", "sierra", "el_capitan"}
+
+var (
+	hostReleaseOnce sync.Once
+	hostReleaseName string
+)
+
+// hostRelease names the running macOS release the way brew's variations
+// do, or "" when it cannot be told
+func hostRelease() string {
+	hostReleaseOnce.Do(func() {
+		out, err := exec.Command("sw_vers", "-productVersion").Output()
+		if err == nil {
+			hostReleaseName = releaseName(strings.TrimSpace(string(out)))
+		}
+	})
+	return hostReleaseName
+}
+
+var releaseNames = map[string]string{
+	"26": "tahoe", "15": "sequoia", "14": "sonoma", "13": "ventura", "12": "monterey", "11": "big_sur",
+	"10.15": "catalina", "10.14": "mojave", "10.13": "high_sierra", "10.12": "sierra", "10.11": "el_capitan",
+}
+
+// "14.5" -> "sonoma", "10.15.7" -> "catalina"
+func releaseName(productVersion string) string {
+	parts := strings.Split(productVersion, ".")
+	if parts[0] == "10" && len(parts) > 1 {
+		return releaseNames["10."+parts[1]]
+	}
+	return releaseNames[parts[0]]
+}
+
+// CheckRepo confirms a GitHub repository exists and is readable.
+func (c *Client) CheckRepo(ctx context.Context, repo string) error {
+	resp, _, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/repos/%s", githubURL, repo), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// DownloadSize asks the download server for the size of url in bytes.
+func (c *Client) DownloadSize(ctx context.Context, url string) (int64, error) {
+	resp, _, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		return req, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &StatusError{Code: resp.StatusCode}
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.New("download size unknown")
+	}
+	return resp.ContentLength, nil
+}
+
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	HTMLURL    string `json:"html_url"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
 }
 
-func parseLatest(typ string, body []byte) (Latest, error) {
+// newest non-draft, non-prerelease tag matching the constraint
+func parseGitHub(body []byte, constraint string) (Latest, error) {
+	var releases []githubRelease
+	if err := json.Unmarshal(body, &releases); err != nil {
+		return Latest{}, err
+	}
+	var check *semver.Constraints
+	if constraint != "" {
+		c, err := semver.NewConstraint(constraint)
+		if err != nil {
+			return Latest{}, fmt.Errorf("invalid constraint %q: %w", constraint, err)
+		}
+		check = c
+	}
+	var best *semver.Version
+	var bestRelease githubRelease
+	for _, r := range releases {
+		if r.Draft || r.Prerelease {
+			continue
+		}
+		v, err := semver.NewVersion(r.TagName)
+		if err != nil {
+			continue
+		}
+		if check != nil && !check.Check(v) {
+			continue
+		}
+		if best == nil || v.GreaterThan(best) {
+			best, bestRelease = v, r
+		}
+	}
+	if best == nil {
+		return Latest{}, errors.New("no matching github release")
+	}
+	return Latest{Version: strings.TrimPrefix(bestRelease.TagName, "v"), Homepage: bestRelease.HTMLURL}, nil
+}
+
+func parseLatest(item config.WatchItem, body []byte) (latest Latest, err error) {
+	typ := item.Type
+	defer func() {
+		if r := recover(); r != nil {
+			latest, err = Latest{}, fmt.Errorf("parse %s json: %v", typ, r)
+		}
+	}()
+	if len(body) == 0 {
+		return Latest{}, errors.New("empty response body")
+	}
+	if item.Source == config.SourceGitHub {
+		return parseGitHub(body, item.Constraint)
+	}
 	switch typ {
 	case "cask":
 		var c caskResp
 		if err := json.Unmarshal(body, &c); err != nil {
 			return Latest{}, err
 		}
-		return Latest{Version: c.Version, Scheme: 0}, nil
+		return Latest{Version: c.version(runtime.GOARCH, hostRelease()), Scheme: 0, Homepage: c.Homepage, URL: c.URL}, nil
 	default:
 		var f formulaResp
 		if err := json.Unmarshal(body, &f); err != nil {
@@ -109,6 +517,6 @@ func parseLatest(typ string, body []byte) (Latest, error) {
 		if version != "" && f.Revision > 0 {
 			version = fmt.Sprintf("%s_%d", version, f.Revision)
 		}
-		return Latest{Version: version, Scheme: f.VersionScheme}, nil
+		return Latest{Version: version, Scheme: f.VersionScheme, Homepage: f.Homepage}, nil
 	}
 }
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/samzong/brew-updater/internal/config"
+)
+
+func TestParseLatestGarbage(t *testing.T) {
+	bodies := map[string]string{
+		"empty":          "",
+		"not json":       "\x00\xff<html>502 Bad Gateway</html>",
+		"truncated":      `{"versions": {"stable": "1.`,
+		"wrong types":    `{"versions": "1.0", "revision": "x"}`,
+		"array":          `[1, 2, 3]`,
+		"cask wrong obj": `{"version": {"arm64": 1}}`,
+	}
+	for _, typ := range []string{"formula", "cask"} {
+		for name, body := range bodies {
+			t.Run(typ+"/"+name, func(t *testing.T) {
+				latest, err := parseLatest(config.WatchItem{Name: "x", Type: typ}, []byte(body))
+				if err == nil && latest.Version != "" {
+					t.Errorf("parseLatest(%q) = %+v, want an error or no version", body, latest)
+				}
+			})
+		}
+	}
+}
+
+func TestParseLatestGitHubGarbage(t *testing.T) {
+	item := config.WatchItem{Name: "x", Type: "formula", Source: config.SourceGitHub, Repo: "o/r"}
+	if _, err := parseLatest(item, []byte(`{"message": "Not Found"}`)); err == nil {
+		t.Error("want an error for a non-array releases response")
+	}
+}
+
+// rewrites every request to the test server, keeping path and headers
+type redirect struct {
+	target *url.URL
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func testClient(t *testing.T, h http.HandlerFunc, retry RetryPolicy) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	c := New(Options{Retry: retry})
+	c.httpClient.Transport = redirect{target: target}
+	return c
+}
+
+func TestFetchLatestGzip(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding = %q, want gzip", r.Header.Get("Accept-Encoding"))
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(`{"versions": {"stable": "2.45.0"}, "revision": 1}`))
+		gz.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}, RetryPolicy{})
+	latest, _, _, err := c.FetchLatest(context.Background(), config.WatchItem{Name: "git", Type: "formula"}, Validators{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != "2.45.0_1" {
+		t.Errorf("version = %q, want 2.45.0_1", latest.Version)
+	}
+}
+
+func TestFetchLatestETag(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 01 May 2024 12:00:00 GMT")
+		w.Write([]byte(`{"version": "125.0"}`))
+	}, RetryPolicy{})
+	item := config.WatchItem{Name: "firefox", Type: "cask"}
+
+	latest, validators, notModified, err := c.FetchLatest(context.Background(), item, Validators{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notModified || latest.Version != "125.0" {
+		t.Errorf("first fetch = %+v notModified=%v, want 125.0", latest, notModified)
+	}
+	if validators.ETag != `"v1"` || validators.LastModified == "" {
+		t.Errorf("validators = %+v, want the response ETag and Last-Modified", validators)
+	}
+
+	latest, cached, notModified, err := c.FetchLatest(context.Background(), item, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !notModified || latest.Version != "" {
+		t.Errorf("second fetch = %+v notModified=%v, want a 304", latest, notModified)
+	}
+	if cached != validators {
+		t.Errorf("validators after 304 = %+v, want them kept", cached)
+	}
+}
+
+// trimmed from a multi-arch cask with no top-level version; the older OS
+// keeps a pinned build that sorts first by name
+const multiArchCask = `{
+	"token": "example",
+	"version": null,
+	"homepage": "https://example.com",
+	"variations": {
+		"arm64_big_sur": {"version": "1.8.0-arm"},
+		"arm64_sonoma": {"version": "2.1.0-arm"},
+		"arm64_ventura": {"version": "2.0.9-arm"},
+		"big_sur": {"version": "1.8.0-intel"},
+		"sonoma": {"version": "2.1.0-intel"},
+		"ventura": {"version": "2.0.9-intel"}
+	}
+}`
+
+func TestCaskVariationVersion(t *testing.T) {
+	var c caskResp
+	if err := json.Unmarshal([]byte(multiArchCask), &c); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arch    string
+		release string
+		want    string
+	}{
+		{"arm64", "ventura", "2.0.9-arm"},
+		{"amd64", "ventura", "2.0.9-intel"},
+		{"arm64", "big_sur", "1.8.0-arm"},
+		// no variation for the running release: newest OS, not big_sur
+		{"arm64", "sequoia", "2.1.0-arm"},
+		{"amd64", "", "2.1.0-intel"},
+	}
+	for _, tt := range tests {
+		if got := c.version(tt.arch, tt.release); got != tt.want {
+			t.Errorf("version(%s, %q) = %q, want %q", tt.arch, tt.release, got, tt.want)
+		}
+	}
+}
+
+func TestCaskUnknownVariation(t *testing.T) {
+	c := caskResp{}
+	c.Variations = map[string]struct {
+		Version string `json:"version"`
+	}{"arm64_future": {Version: "3.0"}, "future": {Version: "3.0-intel"}}
+	if got := c.version("arm64", "sonoma"); got != "3.0" {
+		t.Errorf("version = %q, want the unknown release's 3.0", got)
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	tests := map[string]string{
+		"14.5":    "sonoma",
+		"15.0.1":  "sequoia",
+		"26.0":    "tahoe",
+		"11.7.10": "big_sur",
+		"10.15.7": "catalina",
+		"10.9.5":  "",
+		"":        "",
+	}
+	for in, want := range tests {
+		if got := releaseName(in); got != want {
+			t.Errorf("releaseName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCaskTopLevelVersionWins(t *testing.T) {
+	c := caskResp{Version: "3.0"}
+	c.Variations = map[string]struct {
+		Version string `json:"version"`
+	}{"arm64_sonoma": {Version: "2.9"}}
+	if got := c.version("arm64", "sonoma"); got != "3.0" {
+		t.Errorf("version = %q, want the top-level 3.0", got)
+	}
+}
+
+func TestParseLatestMultiArchCask(t *testing.T) {
+	latest, err := parseLatest(config.WatchItem{Name: "example", Type: "cask"}, []byte(multiArchCask))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version == "" {
+		t.Error("want a version from the variations")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fast := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	item := config.WatchItem{Name: "git", Type: "formula"}
+	tests := []struct {
+		name        string
+		statuses    []int
+		wantCalls   int
+		wantVersion string
+		wantRetries int
+		wantCode    int
+	}{
+		{"ok first time", []int{200}, 1, "2.45.0", 0, 0},
+		{"recovers from 503", []int{503, 502, 200}, 3, "2.45.0", 2, 0},
+		{"recovers from 429", []int{429, 200}, 2, "2.45.0", 1, 0},
+		{"gives up after max attempts", []int{500, 500, 500, 200}, 3, "", 2, 500},
+		{"404 is not retried", []int{404, 200}, 1, "", 0, 404},
+		{"304 is not retried", []int{304, 200}, 1, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				code := tt.statuses[min(calls, len(tt.statuses)-1)]
+				calls++
+				if code != http.StatusOK {
+					w.WriteHeader(code)
+					return
+				}
+				w.Write([]byte(`{"versions": {"stable": "2.45.0"}}`))
+			}, fast)
+			latest, _, _, err := c.FetchLatest(context.Background(), item, Validators{ETag: `"x"`})
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if latest.Version != tt.wantVersion {
+				t.Errorf("version = %q, want %q", latest.Version, tt.wantVersion)
+			}
+			retries := latest.Retries
+			if err != nil {
+				retries = Retries(err)
+			}
+			if retries != tt.wantRetries {
+				t.Errorf("retries = %d, want %d", retries, tt.wantRetries)
+			}
+			var se *StatusError
+			if tt.wantCode != 0 && (!errors.As(err, &se) || se.Code != tt.wantCode) {
+				t.Errorf("err = %v, want status %d", err, tt.wantCode)
+			}
+			if tt.wantCode == 0 && err != nil {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	calls := 0
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, RetryPolicy{MaxAttempts: 1})
+	_, _, _, err := c.FetchLatest(context.Background(), config.WatchItem{Name: "git", Type: "formula"}, Validators{})
+	if calls != 1 || Retries(err) != 0 {
+		t.Errorf("calls = %d retries = %d, want a single attempt", calls, Retries(err))
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	calls := 0
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, _, _, err := c.FetchLatest(ctx, config.WatchItem{Name: "git", Type: "formula"}, Validators{})
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s, want to stop before sleeping past the deadline", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	var re *RetryError
+	if !errors.As(err, &re) {
+		t.Errorf("err = %v, want a RetryError", err)
+	}
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	target, _ := url.Parse(srv.URL)
+	srv.Close() // connections are now refused
+	c := New(Options{Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}})
+	c.httpClient.Transport = redirect{target: target}
+	_, _, _, err := c.FetchLatest(context.Background(), config.WatchItem{Name: "git", Type: "formula"}, Validators{})
+	if !IsNetworkError(err) || Retries(err) != 1 {
+		t.Errorf("err = %v (retries %d), want a network error after one retry", err, Retries(err))
+	}
+}
+
+func TestReachableThroughProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// no DNS lookup of the API host: only the proxy is contacted
+	if err := New(Options{Proxy: "http://" + ln.Addr().String()}).Reachable(context.Background()); err != nil {
+		t.Errorf("proxy listening: %v", err)
+	}
+
+	addr := ln.Addr().String()
+	ln.Close()
+	if err := New(Options{Proxy: "http://" + addr}).Reachable(context.Background()); err == nil {
+		t.Error("proxy down: want an error")
+	}
+}
@@ -2,14 +2,22 @@ package brew
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 var ErrBrewNotFound = errors.New("brew not found")
 
+// where verbose update/upgrade output is written
+var Output io.Writer = os.Stdout
+
 func FindBrew() (string, error) {
 	path, err := exec.LookPath("brew")
 	if err != nil {
@@ -18,23 +26,80 @@ func FindBrew() (string, error) {
 	return path, nil
 }
 
+// read-only, so the two listings can run side by side
 func ListInstalled() (map[string]string, map[string]string, error) {
+	var casks map[string]string
+	var caskErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		casks, caskErr = listCaskVersions()
+	}()
 	formulae, err := listVersions([]string{"list", "--versions"})
+	<-done
 	if err != nil {
 		return nil, nil, err
 	}
-	casks, err := listVersions([]string{"list", "--cask", "--versions"})
-	if err != nil {
-		return nil, nil, err
+	if caskErr != nil {
+		return nil, nil, caskErr
 	}
 	return formulae, casks, nil
 }
 
+// Leaves returns formulae installed on request that no other formula depends on.
+func Leaves() (map[string]bool, error) {
+	out, err := run([]string{"leaves", "--installed-on-request"}, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeaves(out), nil
+}
+
+// tapped formulae are printed as user/tap/name; list --versions uses the bare name
+func parseLeaves(out string) map[string]bool {
+	leaves := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+		leaves[name[strings.LastIndex(name, "/")+1:]] = true
+	}
+	return leaves
+}
+
+// prefer brew info: cask versions may contain spaces
+func listCaskVersions() (map[string]string, error) {
+	out, err := run([]string{"info", "--json=v2", "--installed", "--cask"}, false)
+	if err == nil {
+		var info struct {
+			Casks []struct {
+				Token     string `json:"token"`
+				Installed string `json:"installed"`
+			} `json:"casks"`
+		}
+		if err := json.Unmarshal([]byte(out), &info); err == nil {
+			result := make(map[string]string, len(info.Casks))
+			for _, c := range info.Casks {
+				if c.Installed != "" {
+					result[c.Token] = c.Installed
+				}
+			}
+			return result, nil
+		}
+	}
+	out, err = run([]string{"list", "--cask", "--versions"}, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseCaskVersions(out), nil
+}
+
 func Update(verbose bool) error {
 	args := []string{"update"}
 	out, err := run(args, verbose)
 	if verbose && out != "" {
-		fmt.Print(out)
+		fmt.Fprint(Output, out)
 	}
 	return err
 }
@@ -46,25 +111,86 @@ func UpgradeFormula(names []string, verbose bool) error {
 	args := append([]string{"upgrade"}, names...)
 	out, err := run(args, verbose)
 	if verbose && out != "" {
-		fmt.Print(out)
+		fmt.Fprint(Output, out)
 	}
 	return err
 }
 
-func UpgradeCask(names []string, includeAutoUpdate bool, verbose bool) error {
-	if len(names) == 0 {
-		return nil
+func UpgradeCask(names []string, includeAutoUpdate bool, greedyNames []string, verbose bool) error {
+	normal, greedy := splitGreedy(names, includeAutoUpdate, greedyNames)
+	for _, batch := range []struct {
+		names  []string
+		greedy bool
+	}{{normal, includeAutoUpdate}, {greedy, true}} {
+		if len(batch.names) == 0 {
+			continue
+		}
+		args := []string{"upgrade", "--cask"}
+		if batch.greedy {
+			args = append(args, "--greedy")
+		}
+		args = append(args, batch.names...)
+		out, err := run(args, verbose)
+		if verbose && out != "" {
+			fmt.Fprint(Output, out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// casks in greedyNames get --greedy even when includeAutoUpdate is off
+func splitGreedy(names []string, includeAutoUpdate bool, greedyNames []string) ([]string, []string) {
+	if includeAutoUpdate || len(greedyNames) == 0 {
+		return names, nil
+	}
+	set := make(map[string]bool, len(greedyNames))
+	for _, n := range greedyNames {
+		set[n] = true
 	}
-	args := []string{"upgrade", "--cask"}
+	normal := []string{}
+	greedy := []string{}
+	for _, n := range names {
+		if set[n] {
+			greedy = append(greedy, n)
+		} else {
+			normal = append(normal, n)
+		}
+	}
+	return normal, greedy
+}
+
+func UpgradeDryRun(names []string, cask bool, includeAutoUpdate bool, greedyNames []string) ([]string, error) {
+	if !cask {
+		return upgradeDryRun(append([]string{"--formula"}, names...), names)
+	}
+	normal, greedy := splitGreedy(names, includeAutoUpdate, greedyNames)
+	flags := []string{"--cask"}
 	if includeAutoUpdate {
-		args = append(args, "--greedy")
+		flags = append(flags, "--greedy")
 	}
-	args = append(args, names...)
-	out, err := run(args, verbose)
-	if verbose && out != "" {
-		fmt.Print(out)
+	result, err := upgradeDryRun(append(flags, normal...), normal)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	more, err := upgradeDryRun(append([]string{"--cask", "--greedy"}, greedy...), greedy)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, more...), nil
+}
+
+func upgradeDryRun(flags []string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return []string{}, nil
+	}
+	out, err := run(append([]string{"upgrade", "--dry-run"}, flags...), false)
+	if err != nil {
+		return nil, err
+	}
+	return parseDryRun(out), nil
 }
 
 func OutdatedFormula(names []string) ([]string, error) {
@@ -79,12 +205,25 @@ func OutdatedFormula(names []string) ([]string, error) {
 	return parseOutdated(out), nil
 }
 
-func OutdatedCask(names []string, includeAutoUpdate bool) ([]string, error) {
+func OutdatedCask(names []string, includeAutoUpdate bool, greedyNames []string) ([]string, error) {
+	normal, greedy := splitGreedy(names, includeAutoUpdate, greedyNames)
+	result, err := outdatedCask(normal, includeAutoUpdate)
+	if err != nil {
+		return nil, err
+	}
+	more, err := outdatedCask(greedy, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, more...), nil
+}
+
+func outdatedCask(names []string, greedy bool) ([]string, error) {
 	if len(names) == 0 {
 		return []string{}, nil
 	}
 	args := []string{"outdated", "--quiet", "--cask"}
-	if includeAutoUpdate {
+	if greedy {
 		args = append(args, "--greedy")
 	}
 	args = append(args, names...)
@@ -95,6 +234,38 @@ func OutdatedCask(names []string, includeAutoUpdate bool) ([]string, error) {
 	return parseOutdated(out), nil
 }
 
+func CanonicalName(name string, typ string) (string, error) {
+	args := []string{"info", "--json=v2"}
+	if typ == "cask" {
+		args = append(args, "--cask")
+	} else {
+		args = append(args, "--formula")
+	}
+	args = append(args, name)
+	out, err := run(args, false)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Formulae []struct {
+			Name string `json:"name"`
+		} `json:"formulae"`
+		Casks []struct {
+			Token string `json:"token"`
+		} `json:"casks"`
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return "", err
+	}
+	if typ == "cask" && len(info.Casks) > 0 {
+		return info.Casks[0].Token, nil
+	}
+	if typ != "cask" && len(info.Formulae) > 0 {
+		return info.Formulae[0].Name, nil
+	}
+	return "", fmt.Errorf("brew info returned no %s for %s", typ, name)
+}
+
 func HasRunningBrew() (bool, error) {
 	cmd := exec.Command("pgrep", "-x", "brew")
 	out, err := cmd.Output()
@@ -108,11 +279,99 @@ func HasRunningBrew() (bool, error) {
 	return strings.TrimSpace(string(out)) != "", nil
 }
 
+func Prefix() (string, error) {
+	out, err := run([]string{"--prefix"}, false)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// a stalled or backgrounded brew can hold its locks without a brew process
+func HasActiveLocks(prefix string) (bool, error) {
+	dir := filepath.Join(prefix, "var", "homebrew", "locks")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		if err == nil {
+			_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		}
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// W_OK from <unistd.h>; syscall has Access but not the mode bits
+const wOK = 0x2
+
+// managed Macs often have brew owned by another account
+func UnwritableDirs(prefix string) []string {
+	dirs := []string{}
+	for _, name := range []string{"Cellar", "Caskroom"} {
+		dir := filepath.Join(prefix, name)
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		// access(2) asks without touching Homebrew's directories
+		if err := syscall.Access(dir, wOK); err != nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
 func listVersions(args []string) (map[string]string, error) {
 	out, err := run(args, false)
 	if err != nil {
 		return nil, err
 	}
+	return parseVersions(out), nil
+}
+
+// ParseInstalledDump reads saved `brew list --versions` output, e.g. from
+// another machine. Lines after a "==> Casks" header are casks and lines after
+// "==> Formulae" are formulae; without headers a line counts as either.
+func ParseInstalledDump(data string) (map[string]string, map[string]string) {
+	formulae := make(map[string]string)
+	casks := make(map[string]string)
+	section := ""
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "==>") {
+			section = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "==>")))
+			continue
+		}
+		if section != "casks" {
+			for name, version := range parseVersions(line) {
+				formulae[name] = version
+			}
+		}
+		if section != "formulae" {
+			for name, version := range parseCaskVersions(line) {
+				casks[name] = version
+			}
+		}
+	}
+	return formulae, casks
+}
+
+func parseVersions(out string) map[string]string {
 	result := make(map[string]string)
 	lines := strings.Split(strings.TrimSpace(out), "\n")
 	for _, line := range lines {
@@ -128,7 +387,7 @@ func listVersions(args []string) (map[string]string, error) {
 		version := fields[1]
 		result[name] = version
 	}
-	return result, nil
+	return result
 }
 
 func run(args []string, verbose bool) (string, error) {
@@ -149,6 +408,32 @@ func run(args []string, verbose bool) (string, error) {
 	return stdout.String(), nil
 }
 
+// the cask version is everything after the token
+func parseCaskVersions(out string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		name, version, ok := strings.Cut(strings.TrimSpace(line), " ")
+		version = strings.TrimSpace(version)
+		if !ok || name == "" || version == "" {
+			continue
+		}
+		result[name] = version
+	}
+	return result
+}
+
+func parseDryRun(out string) []string {
+	result := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "==>") || !strings.Contains(line, "->") {
+			continue
+		}
+		result = append(result, strings.Fields(line)[0])
+	}
+	return result
+}
+
 func parseOutdated(out string) []string {
 	lines := strings.Split(strings.TrimSpace(out), "\n")
 	result := make([]string, 0, len(lines))
@@ -0,0 +1,99 @@
+package brew
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeBrew puts a brew script on PATH; script is the body of a POSIX sh
+// case statement over "$*"
+func fakeBrew(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	body := "#!/bin/sh\ncase \"$*\" in\n" + script + "\n*) echo \"unexpected: $*\" >&2; exit 1 ;;\nesac\n"
+	if err := os.WriteFile(filepath.Join(dir, "brew"), []byte(body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestParseCaskVersions(t *testing.T) {
+	out := "firefox 125.0.3\n" +
+		"adobe-acrobat-reader 24.002.20759 (2024)\n" +
+		"  docker   4.29.0,145265  \n" +
+		"broken\n"
+	want := map[string]string{
+		"firefox":              "125.0.3",
+		"adobe-acrobat-reader": "24.002.20759 (2024)",
+		"docker":               "4.29.0,145265",
+	}
+	if got := parseCaskVersions(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCaskVersions = %v, want %v", got, want)
+	}
+}
+
+func TestListCaskVersionsPrefersInfo(t *testing.T) {
+	fakeBrew(t, `"info --json=v2 --installed --cask")
+	echo '{"casks": [{"token": "zoom", "installed": "6.0.2 (33403)"}, {"token": "gone", "installed": null}]}' ;;`)
+	got, err := listCaskVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"zoom": "6.0.2 (33403)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listCaskVersions = %v, want %v", got, want)
+	}
+}
+
+func TestListCaskVersionsFallsBackToList(t *testing.T) {
+	fakeBrew(t, `"info --json=v2 --installed --cask") echo 'not json' ;;
+"list --cask --versions") printf 'zoom 6.0.2 (33403)\n' ;;`)
+	got, err := listCaskVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"zoom": "6.0.2 (33403)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listCaskVersions = %v, want %v", got, want)
+	}
+}
+
+func TestListInstalled(t *testing.T) {
+	fakeBrew(t, `"list --versions") printf 'git 2.45.0\nnode 22.1.0 21.7.3\n' ;;
+"info --json=v2 --installed --cask") echo '{"casks": [{"token": "firefox", "installed": "125.0.3"}]}' ;;`)
+	formulae, casks, err := ListInstalled()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"git": "2.45.0", "node": "22.1.0"}; !reflect.DeepEqual(formulae, want) {
+		t.Errorf("formulae = %v, want %v", formulae, want)
+	}
+	if want := map[string]string{"firefox": "125.0.3"}; !reflect.DeepEqual(casks, want) {
+		t.Errorf("casks = %v, want %v", casks, want)
+	}
+}
+
+func TestListInstalledErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"formula listing fails", `"list --versions") echo boom >&2; exit 1 ;;
+"info --json=v2 --installed --cask") echo '{"casks": []}' ;;`},
+		{"cask listing fails", `"list --versions") echo 'git 2.45.0' ;;
+"info --json=v2 --installed --cask") exit 1 ;;
+"list --cask --versions") echo boom >&2; exit 1 ;;`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeBrew(t, tt.script)
+			formulae, casks, err := ListInstalled()
+			if err == nil {
+				t.Fatal("want an error")
+			}
+			if formulae != nil || casks != nil {
+				t.Errorf("got partial results %v %v alongside the error", formulae, casks)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package brew
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type BrewfileEntry struct {
+	Name string
+	Type string
+}
+
+var brewfileLine = regexp.MustCompile(`^\s*(brew|cask)\s+["']([^"']+)["']`)
+
+// ParseBrewfile reads the brew and cask entries of a Brewfile; taps, mas and
+// other entries are ignored. Tapped formula names keep only the last segment.
+func ParseBrewfile(r io.Reader) ([]BrewfileEntry, error) {
+	entries := []BrewfileEntry{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		m := brewfileLine.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		typ := "formula"
+		if m[1] == "cask" {
+			typ = "cask"
+		}
+		name := m[2]
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		entries = append(entries, BrewfileEntry{Name: name, Type: typ})
+	}
+	return entries, sc.Err()
+}
+
+func WriteBrewfile(w io.Writer, entries []BrewfileEntry) error {
+	for _, typ := range []string{"formula", "cask"} {
+		for _, e := range entries {
+			if e.Type != typ {
+				continue
+			}
+			keyword := "brew"
+			if typ == "cask" {
+				keyword = "cask"
+			}
+			if _, err := fmt.Fprintf(w, "%s %q\n", keyword, e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package brew
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const retryBaseDelay = 5 * time.Second
+
+// stderr fragments brew/curl print for download and connection failures;
+// anything else (build errors, conflicts) is not worth retrying
+var retryablePatterns = []string{
+	"curl:",
+	"failed to download",
+	"download failed",
+	"could not resolve host",
+	"connection reset",
+	"connection refused",
+	"timed out",
+}
+
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range retryablePatterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func Retry(ctx context.Context, retries int, fn func() error, onRetry func(attempt int, err error)) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > retries || !IsRetryable(err) {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -3,28 +3,83 @@ package check
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/samzong/brew-updater/internal/api"
 	"github.com/samzong/brew-updater/internal/brew"
 	"github.com/samzong/brew-updater/internal/config"
+	"github.com/samzong/brew-updater/internal/hook"
 	"github.com/samzong/brew-updater/internal/notify"
+	"github.com/samzong/brew-updater/internal/version"
 )
 
 type Options struct {
-	DryRun      bool
-	ForceUpdate bool
-	NotifyOnly  bool
-	Verbose     bool
+	DryRun           bool
+	ForceUpdate      bool
+	NotifyOnly       bool
+	Verbose          bool
+	Version          string
+	MaxAge           time.Duration
+	ResumeGap        time.Duration
+	NotifyThreshold  int
+	MaxPackages      int
+	CatchUp          bool
+	Type             string
+	FetchTimeout     time.Duration
+	Greedy           *bool
+	Preview          bool
+	MaxErrorsAbort   int
+	Serial           bool
+	Retries          int
+	NotifyOnError    bool
+	OnlyPolicy       string
+	Offline          bool
+	ForceCheck       bool
+	GracePeriod      time.Duration
+	Simulate         map[string]string
+	RefreshInstalled bool
+	OnlyChanged      bool
+	HostConcurrency  map[string]int
+	RecheckBrew      bool
+	AutoParallelism  bool
+	NotifyOnRemoved  bool
+	DeferCasks       bool
+	CasksNow         bool
+	PreferBrew       bool
+	MaxUpgradeSize   int64
+	BrewBusyWait     time.Duration
+	// brew --prefix when the caller already ran it
+	BrewPrefix    string
+	ListInstalled func() (map[string]string, map[string]string, error)
+	// skip conditional requests and leave the stored ETags untouched
+	NoETags bool
+	// called as each package result is evaluated, before any brew update
+	// or upgrade runs
+	OnPackage func(PackageStatus)
 }
 
 type OutdatedItem struct {
 	Item      config.WatchItem
 	Installed string
 	Latest    string
+	Homepage  string
+	URL       string
+}
+
+type PackageStatus struct {
+	Item      config.WatchItem
+	Installed string
+	Latest    string
+	Outdated  bool
+	Err       error
 }
 
 type Result struct {
@@ -32,16 +87,89 @@ type Result struct {
 	CheckedNames []string
 	Outdated     []OutdatedItem
 	Removed      []config.WatchItem
+	Resolved     []config.WatchItem
+	Deferred     []string
+	OverBudget   int
+	Disputed     []OutdatedItem
+	TooLarge     []string
 	Errors       []string
+	Warnings     []string
+	Statuses     []PackageStatus
+	Preview      []string
+	Timings      []Timing
+	FetchTiming  FetchTiming
+	Diff         Diff
+}
+
+// changes since the previous check of the same packages
+type Diff struct {
+	NewVersions   []VersionChange
+	NewlyOutdated []config.WatchItem
+	UpToDate      []config.WatchItem
+}
+
+type VersionChange struct {
+	Item config.WatchItem
+	From string
+	To   string
+}
+
+type Timing struct {
+	Phase   string
+	Elapsed time.Duration
+}
+
+type FetchTiming struct {
+	Min time.Duration
+	Max time.Duration
+	Avg time.Duration
+	// transient API failures retried across all packages
+	Retries int
 }
 
 func Run(ctx context.Context, cfg config.Config, st config.State, opts Options) (Result, config.Config, config.State, error) {
+	res, cfg, st, err := run(ctx, cfg, st, opts)
+	// offline runs audit another machine; keep this one's notifications quiet
+	if err == nil && !opts.Offline && (opts.NotifyOnError || cfg.NotifyOnError) {
+		notifyErrors(cfg, &st, len(res.Errors), time.Now())
+	}
+	if err == nil && !opts.Offline && (opts.NotifyOnRemoved || cfg.NotifyOnRemoved) {
+		notifyRemoved(cfg, res.Removed)
+	}
+	return res, cfg, st, err
+}
+
+func run(ctx context.Context, cfg config.Config, st config.State, opts Options) (Result, config.Config, config.State, error) {
 	res := Result{}
+	// LastErrors keeps history across runs; this counts only the current one
+	st.LastRunErrors = 0
+	fail := func(msg string) {
+		appendError(&st, msg)
+		res.Errors = append(res.Errors, msg)
+	}
+	track := func(phase string, start time.Time) {
+		res.Timings = append(res.Timings, Timing{Phase: phase, Elapsed: time.Since(start)})
+	}
 
-	formulae, casks, err := brew.ListInstalled()
+	started := time.Now()
+	refreshed := opts.RefreshInstalled && !opts.Offline
+	if refreshed {
+		// pick up packages installed or tapped since the last brew update
+		if err := brew.Update(opts.Verbose); err != nil {
+			return res, cfg, st, err
+		}
+		track("brew update", started)
+		started = time.Now()
+	}
+	listInstalled := brew.ListInstalled
+	if opts.ListInstalled != nil {
+		listInstalled = opts.ListInstalled
+	}
+	formulae, casks, err := listInstalled()
 	if err != nil {
 		return res, cfg, st, err
 	}
+	track("list installed", started)
 	normalizeStateKeys(cfg, &st)
 
 	// remove missing
@@ -66,26 +194,123 @@ func Run(ctx context.Context, cfg config.Config, st config.State, opts Options)
 	cleanupStateKeys(cfg, &st)
 
 	now := time.Now()
-	due := dueItems(cfg, st, now)
+	started = now
+	stale := staleKeys(cfg, st, now, maxVersionAge(cfg, opts))
+	force := stale
+	if opts.ForceCheck || resumed(st, now, opts.ResumeGap) {
+		force = allKeys(cfg)
+	}
+	due := filterType(dueItems(cfg, st, now, force), opts.Type)
+	if !opts.CatchUp && !opts.ForceCheck {
+		maxPackages := cfg.MaxPackagesPerRun
+		if opts.MaxPackages > 0 {
+			maxPackages = opts.MaxPackages
+		}
+		due = capDue(due, st, maxPackages)
+	}
+	if len(opts.Simulate) > 0 {
+		due = simulatedItems(cfg, opts.Simulate)
+	} else if cfg.APIRequestsPerHour > 0 && !opts.CatchUp {
+		// packages over budget keep their next check time and stay due
+		allowed := takeBudget(&st, cfg.APIRequestsPerHour, len(due), now)
+		res.OverBudget = len(due) - allowed
+		if allowed == 0 {
+			due = nil
+		} else {
+			due = capDue(due, st, allowed)
+		}
+	}
 	res.Checked = len(due)
 	res.CheckedNames = namesFromItems(due)
+	track("due computation", started)
 	if len(due) == 0 {
-		st.LastCheckAt = ptrTime(now)
+		markChecked(&st, opts.Type, now)
 		return res, cfg, st, nil
 	}
 
-	client := api.New()
-	results := fetchLatest(ctx, client, due, &st)
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = api.DefaultUserAgent(opts.Version)
+	}
+	retryPolicy := api.RetryPolicy{MaxAttempts: cfg.APIMaxAttempts}
+	if opts.CatchUp {
+		// drain the backlog now; failures are retried by the next tick instead
+		retryPolicy.MaxAttempts = 1
+	}
+	client := api.New(api.Options{UserAgent: userAgent, Retry: retryPolicy, Proxy: cfg.Proxy})
+	fetchTimeout := time.Duration(cfg.APIFetchTimeoutSec) * time.Second
+	if opts.FetchTimeout > 0 {
+		fetchTimeout = opts.FetchTimeout
+	}
+	maxErrors := cfg.MaxErrorsAbort
+	if opts.MaxErrorsAbort > 0 {
+		maxErrors = opts.MaxErrorsAbort
+	}
+	hostLimits := hostConcurrency(cfg.HostConcurrency, opts.HostConcurrency)
+	// total requests in flight; the per-host limits apply within it
+	workers := cfg.FetchConcurrency
+	if workers < 1 {
+		workers = config.DefaultFetchWorkers
+	}
+	var limit *adaptiveLimit
+	if opts.AutoParallelism && !opts.Serial {
+		workers = autoWorkers(len(due))
+		limit = newAdaptiveLimit(workers)
+	}
+	if opts.Serial {
+		workers = 1
+	}
+	// the fetch phase finishes before any brew command below runs, and those
+	// run one at a time; Serial additionally fetches one package at a time
+	started = time.Now()
+	var results []fetchResult
+	aborted := false
+	if len(opts.Simulate) > 0 {
+		results = simulateLatest(due, opts.Simulate)
+	} else {
+		results, aborted = fetchLatest(ctx, client, due, &st, fetchOptions{fresh: stale, noETags: opts.NoETags, timeout: fetchTimeout, maxErrors: maxErrors, workers: workers, hostLimits: hostLimits, limit: limit})
+	}
+	track("api fetch", started)
+	res.FetchTiming = fetchTiming(results)
+	if aborted {
+		// leave NextCheckAt untouched so the next tick retries everything
+		msg := fmt.Sprintf("network appears down, aborting after %d failed fetches", maxErrors)
+		fail(msg)
+		markChecked(&st, opts.Type, now)
+		return res, cfg, st, nil
+	}
 
 	outdated := make([]OutdatedItem, 0)
+	changed := make(map[string]bool)
+	addStatus := func(ps PackageStatus) {
+		res.Statuses = append(res.Statuses, ps)
+		if opts.OnPackage != nil {
+			opts.OnPackage(ps)
+		}
+	}
 	for _, r := range results {
+		if api.IsNotFound(r.err) && !opts.Offline && r.item.Source != config.SourceGitHub {
+			if resolved, ok := resolveRenamed(ctx, client, r, fetchTimeout); ok {
+				r = resolved
+				setResolvedName(&cfg, r.item)
+				res.Resolved = append(res.Resolved, r.item)
+			}
+		}
 		if r.err != nil {
-			appendError(&st, fmt.Sprintf("%s: %v", r.item.Name, r.err))
+			fail(fmt.Sprintf("%s: %v", r.item.Name, r.err))
+			addStatus(PackageStatus{Item: r.item, Err: r.err})
+			st.RecordCheck(config.WatchKey(r.item.Name, r.item.Type), config.Check{At: now, Error: r.err.Error()})
+			scheduleRetry(&st, r.item, now)
 			continue
 		}
 		url := api.URLFor(r.item)
 		key := config.WatchKey(r.item.Name, r.item.Type)
+		delete(st.FetchFailures, key)
 		prevScheme := st.LastSchemes[key]
+		prevLatest, ok := st.LastVersions[key]
+		if !ok {
+			prevLatest = st.LastVersions[r.item.Name]
+		}
 		if r.notModified {
 			if last, ok := st.LastVersions[key]; ok {
 				r.latest = last
@@ -98,8 +323,17 @@ func Run(ctx context.Context, cfg config.Config, st config.State, opts Options)
 				r.scheme = scheme
 			}
 		} else {
-			if r.etag != "" {
-				st.ETagCache[url] = r.etag
+			if !opts.NoETags {
+				if r.etag != "" {
+					st.ETagCache[url] = r.etag
+				} else {
+					delete(st.ETagCache, url)
+				}
+				if r.lastModified != "" {
+					st.LastModified[url] = r.lastModified
+				} else {
+					delete(st.LastModified, url)
+				}
 			}
 			if r.latest != "" {
 				st.LastVersions[key] = r.latest
@@ -111,10 +345,49 @@ func Run(ctx context.Context, cfg config.Config, st config.State, opts Options)
 			if key != r.item.Name {
 				delete(st.LastSchemes, r.item.Name)
 			}
+			st.LastFetchAt[key] = now.Format(time.RFC3339)
+		}
+		if r.latest != "" {
+			if _, ok := st.VersionFirstSeen[config.VersionKey(key, r.latest)]; !ok {
+				st.VersionFirstSeen[config.VersionKey(key, r.latest)] = now.Format(time.RFC3339)
+			}
 		}
 		installedVersion := installed[key]
-		if isOutdated(installedVersion, r.latest, r.scheme, prevScheme) {
-			outdated = append(outdated, OutdatedItem{Item: r.item, Installed: installedVersion, Latest: r.latest})
+		schemes := version.Options{Scheme: r.scheme, PrevScheme: prevScheme}
+		stale := version.Outdated(installedVersion, r.latest, schemes)
+		if baseline, ok := st.Baselines[key]; ok {
+			// watched with --since-version: wait for a release newer than the baseline
+			if stale && !version.Outdated(baseline, r.latest, schemes) {
+				stale = false
+			} else if stale || installedVersion != baseline {
+				delete(st.Baselines, key)
+			}
+		}
+		addStatus(PackageStatus{Item: r.item, Installed: installedVersion, Latest: r.latest, Outdated: stale})
+		st.RecordCheck(key, config.Check{At: now, Latest: r.latest, Outdated: stale})
+		if r.latest != "" && prevLatest != r.latest {
+			changed[key] = true
+		}
+		if prevLatest != "" && r.latest != "" && prevLatest != r.latest {
+			res.Diff.NewVersions = append(res.Diff.NewVersions, VersionChange{Item: r.item, From: prevLatest, To: r.latest})
+		}
+		if _, wasPending := st.Pending[key]; stale && !wasPending {
+			res.Diff.NewlyOutdated = append(res.Diff.NewlyOutdated, r.item)
+		} else if !stale && wasPending {
+			res.Diff.UpToDate = append(res.Diff.UpToDate, r.item)
+		}
+		if stale {
+			homepage, downloadURL := r.homepage, r.url
+			if homepage == "" {
+				homepage = st.Pending[key].Homepage
+			}
+			if downloadURL == "" {
+				downloadURL = st.Pending[key].URL
+			}
+			outdated = append(outdated, OutdatedItem{Item: r.item, Installed: installedVersion, Latest: r.latest, Homepage: homepage, URL: downloadURL})
+			st.Pending[key] = config.Pending{Installed: installedVersion, Latest: r.latest, Homepage: homepage, URL: downloadURL}
+		} else {
+			delete(st.Pending, key)
 		}
 		// update next check time for this item
 		st.NextCheckAt[key] = now.Add(time.Duration(r.item.IntervalMin) * time.Minute).Format(time.RFC3339)
@@ -122,98 +395,440 @@ func Run(ctx context.Context, cfg config.Config, st config.State, opts Options)
 			delete(st.NextCheckAt, r.item.Name)
 		}
 	}
+	// fetch results arrive in completion order; make the result canonical
+	sortOutdated(outdated)
+	if opts.OnlyPolicy != "" {
+		outdated = filterPolicy(outdated, cfg, opts.OnlyPolicy)
+	}
+	pruneFirstSeen(cfg, &st)
 	res.Outdated = outdated
+	// reporting and notifications only; upgrades still cover everything
+	reported := outdated
+	if opts.OnlyChanged {
+		reported = filterChanged(outdated, changed)
+		res.Outdated = reported
+	}
+	notifyOnly := opts.NotifyOnly || opts.OnlyPolicy == "notify"
+	greedy := cfg.IncludeAutoUpdateCask
+	if opts.Greedy != nil {
+		greedy = *opts.Greedy
+	}
+	// the API can be ahead of local formula metadata; keep only what brew
+	// itself reports as outdated and set the rest aside as disputed. upgrade
+	// runs always do this after brew update, dry and notify-only runs only
+	// with PreferBrew since they never refresh brew's metadata
+	trustBrew := func() {
+		if len(opts.Simulate) > 0 {
+			// simulated versions exist only here; brew would dispute them all
+			return
+		}
+		confirmed, err := brewConfirmed(outdated, greedy, cfg.GreedyCasks)
+		if err != nil {
+			fail(fmt.Sprintf("brew outdated failed: %v", err))
+			return
+		}
+		var disputed []OutdatedItem
+		outdated, disputed = splitConfirmed(outdated, confirmed)
+		reported, _ = splitConfirmed(reported, confirmed)
+		res.Outdated = reported
+		res.Disputed = append(res.Disputed, disputed...)
+	}
 
-	updated := false
-	if opts.ForceUpdate && !opts.DryRun && !opts.NotifyOnly {
-		if err := brew.Update(opts.Verbose); err != nil {
-			appendError(&st, fmt.Sprintf("brew update failed: %v", err))
-			notifyFailure(cfg, "brew update failed", err)
-			st.LastCheckAt = ptrTime(now)
-			return res, cfg, st, nil
+	if opts.Offline {
+		// audit only: never run brew or notify
+		markChecked(&st, opts.Type, now)
+		return res, cfg, st, nil
+	}
+
+	retries := cfg.BrewRetries
+	if opts.Retries > 0 {
+		retries = opts.Retries
+	}
+	retry := func(op string, fn func() error) error {
+		return brew.Retry(ctx, retries, fn, func(attempt int, err error) {
+			appendError(&st, fmt.Sprintf("%s attempt %d failed, retrying: %v", op, attempt, err))
+		})
+	}
+
+	deferCasks := (opts.DeferCasks || cfg.DeferCasks) && !opts.CasksNow && !inWindow(cfg.CaskUpgradeWindow, now)
+	// casks deferred by earlier runs are upgraded once deferring stops, due or not
+	var resumedCasks []OutdatedItem
+	if !deferCasks && opts.Type != "formula" {
+		resumedCasks = deferredCasks(cfg, st, outdated)
+	}
+
+	updated := refreshed
+	if opts.ForceUpdate && !updated && !opts.DryRun && !notifyOnly {
+		started = time.Now()
+		err := retry("brew update", func() error { return brew.Update(opts.Verbose) })
+		track("brew update", started)
+		if err != nil {
+			if !cfg.ContinueOnUpdateFailure {
+				fail(fmt.Sprintf("brew update failed: %v", err))
+				notifyFailure(cfg, "brew update failed", err)
+				markChecked(&st, opts.Type, now)
+				return res, cfg, st, nil
+			}
+			fail(fmt.Sprintf("warning: brew update failed, continuing: %v", err))
 		}
 		updated = true
 	}
 
-	if len(outdated) == 0 {
-		st.LastCheckAt = ptrTime(now)
+	if len(outdated) == 0 && len(resumedCasks) == 0 {
+		markChecked(&st, opts.Type, now)
 		return res, cfg, st, nil
 	}
 
-	if opts.DryRun || opts.NotifyOnly {
-		notifyUpdates(cfg, outdated, "Update available", true)
-		st.LastCheckAt = ptrTime(now)
+	threshold := cfg.NotifyThreshold
+	if opts.NotifyThreshold > 0 {
+		threshold = opts.NotifyThreshold
+	}
+	if opts.DryRun || notifyOnly {
+		if opts.PreferBrew {
+			trustBrew()
+		}
+		notifyUpdates(cfg, reported, "Update available", true, threshold)
+		markChecked(&st, opts.Type, now)
 		return res, cfg, st, nil
 	}
 
-	if !updated && len(outdated) > 0 {
-		if err := brew.Update(opts.Verbose); err != nil {
-			appendError(&st, fmt.Sprintf("brew update failed: %v", err))
-			notifyFailure(cfg, "brew update failed", err)
-			st.LastCheckAt = ptrTime(now)
-			return res, cfg, st, nil
+	grace := time.Duration(cfg.UpgradeGracePeriodMin) * time.Minute
+	if opts.GracePeriod > 0 {
+		grace = opts.GracePeriod
+	}
+	outdated, held := holdNewReleases(outdated, cfg, st, now, grace)
+	if len(held) > 0 {
+		if opts.OnlyChanged {
+			held = filterChanged(held, changed)
+		}
+		// a release stays held for the whole grace period; notify once per version
+		notifyUpdates(cfg, freshHeld(&st, held), "Update available", true, threshold)
+	}
+	if len(outdated) == 0 && len(resumedCasks) == 0 {
+		markChecked(&st, opts.Type, now)
+		return res, cfg, st, nil
+	}
+
+	if !updated {
+		started = time.Now()
+		err := retry("brew update", func() error { return brew.Update(opts.Verbose) })
+		track("brew update", started)
+		if err != nil {
+			if !cfg.ContinueOnUpdateFailure {
+				fail(fmt.Sprintf("brew update failed: %v", err))
+				notifyFailure(cfg, "brew update failed", err)
+				markChecked(&st, opts.Type, now)
+				return res, cfg, st, nil
+			}
+			fail(fmt.Sprintf("warning: brew update failed, continuing: %v", err))
 		}
 	}
+	// after brew update, brew's own accounting decides what is reported and
+	// upgraded; notifications still show the API version
+	resumed := make(map[string]bool, len(resumedCasks))
+	for _, item := range resumedCasks {
+		resumed[config.WatchKey(item.Item.Name, item.Item.Type)] = true
+	}
+	outdated = append(outdated, resumedCasks...)
+	started = time.Now()
+	trustBrew()
+	track("brew outdated", started)
+	if len(outdated) == 0 {
+		markChecked(&st, opts.Type, now)
+		return res, cfg, st, nil
+	}
+
+	announce := make([]OutdatedItem, 0, len(outdated))
+	for _, item := range outdated {
+		if !resumed[config.WatchKey(item.Item.Name, item.Item.Type)] {
+			announce = append(announce, item)
+		}
+	}
+	if opts.OnlyChanged {
+		announce = filterChanged(announce, changed)
+	}
+	notifyUpdates(cfg, announce, "Update available", false, threshold)
 
 	toUpgradeFormula, toUpgradeCask := splitByType(outdated, cfg)
-	if len(toUpgradeFormula) > 0 {
-		if names, err := brew.OutdatedFormula(toUpgradeFormula); err == nil {
-			toUpgradeFormula = names
-		} else {
-			appendError(&st, fmt.Sprintf("brew outdated formula failed: %v", err))
+	toUpgradeFormula, toUpgradeCask = preferType(toUpgradeFormula, toUpgradeCask, cfg.PreferType)
+	if deferCasks && len(toUpgradeCask) > 0 {
+		// auto casks are normally upgraded silently; tell the user once per version instead
+		fresh := []string{}
+		for _, name := range toUpgradeCask {
+			key := config.WatchKey(name, "cask")
+			if latest := st.Pending[key].Latest; st.DeferredCasks[key] != latest {
+				st.DeferredCasks[key] = latest
+				fresh = append(fresh, name)
+			}
 		}
+		notifyUpdates(cfg, filterOutdated(outdated, nil, fresh), "Update available", true, threshold)
+		res.Deferred = toUpgradeCask
+		toUpgradeCask = nil
 	}
-	if len(toUpgradeCask) > 0 {
-		if names, err := brew.OutdatedCask(toUpgradeCask, cfg.IncludeAutoUpdateCask); err == nil {
-			toUpgradeCask = names
-		} else {
-			appendError(&st, fmt.Sprintf("brew outdated cask failed: %v", err))
+	maxSize := int64(cfg.MaxUpgradeSizeMB) << 20
+	if opts.MaxUpgradeSize > 0 {
+		maxSize = opts.MaxUpgradeSize
+	}
+	if maxSize > 0 && len(toUpgradeCask) > 0 {
+		// sizes come from the cask download URL; formula bottles are not checked
+		var large []string
+		toUpgradeCask, large = splitBySize(ctx, client, outdated, toUpgradeCask, maxSize, fetchTimeout)
+		// notify once per version; they stay pending and are re-checked when due
+		fresh := []string{}
+		for _, name := range large {
+			key := config.WatchKey(name, "cask")
+			if latest := st.Pending[key].Latest; st.TooLarge[key] != latest {
+				st.TooLarge[key] = latest
+				fresh = append(fresh, name)
+			}
 		}
+		notifyUpdates(cfg, filterOutdated(outdated, nil, fresh), "Update available", true, threshold)
+		res.TooLarge = large
 	}
 	if len(toUpgradeFormula) == 0 && len(toUpgradeCask) == 0 {
-		st.LastCheckAt = ptrTime(now)
+		markChecked(&st, opts.Type, now)
 		return res, cfg, st, nil
 	}
 	res.Outdated = filterOutdated(outdated, toUpgradeFormula, toUpgradeCask)
-	if err := brew.UpgradeFormula(toUpgradeFormula, opts.Verbose); err != nil {
-		appendError(&st, fmt.Sprintf("formula upgrade failed: %v", err))
+	// warn once; the upgrade still runs and brew reports the real failure
+	prefix := opts.BrewPrefix
+	if prefix == "" {
+		prefix, _ = brew.Prefix()
+	}
+	if prefix != "" {
+		dirs := brew.UnwritableDirs(prefix)
+		if len(dirs) > 0 && !st.WarnedUnwritable {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("Homebrew directories not writable by current user (%s); run `brew-updater doctor`", strings.Join(dirs, ", ")))
+		}
+		st.WarnedUnwritable = len(dirs) > 0
+	}
+	if opts.Preview || cfg.PreviewUpgrades || cfg.MaxUpgradeFanout > 0 {
+		preview, err := previewUpgrades(toUpgradeFormula, toUpgradeCask, greedy, cfg.GreedyCasks)
+		if err != nil {
+			fail(fmt.Sprintf("brew upgrade --dry-run failed: %v", err))
+		}
+		res.Preview = preview
+		if limit := cfg.MaxUpgradeFanout; limit > 0 && len(preview) > limit {
+			err := fmt.Errorf("%d packages would change (limit %d)", len(preview), limit)
+			fail(fmt.Sprintf("upgrade skipped: %v", err))
+			notifyFailure(cfg, "upgrade skipped", err)
+			markChecked(&st, opts.Type, now)
+			return res, cfg, st, nil
+		}
+	}
+	if opts.RecheckBrew && brewStillRunning(ctx, opts.BrewBusyWait) {
+		// the user started brew while we were fetching; two upgrades at once can corrupt the Cellar
+		fail("upgrade skipped: another brew process is running")
+		markChecked(&st, opts.Type, now)
+		return res, cfg, st, nil
+	}
+	started = time.Now()
+	if err := retry("formula upgrade", func() error { return brew.UpgradeFormula(toUpgradeFormula, opts.Verbose) }); err != nil {
+		fail(fmt.Sprintf("formula upgrade failed: %v", err))
 		notifyFailure(cfg, "formula upgrade failed", err)
+	} else {
+		clearPending(&st, "formula", toUpgradeFormula)
+		runPackageHooks(ctx, cfg, &st, res.Outdated, "formula", toUpgradeFormula)
 	}
-	if err := brew.UpgradeCask(toUpgradeCask, cfg.IncludeAutoUpdateCask, opts.Verbose); err != nil {
-		appendError(&st, fmt.Sprintf("cask upgrade failed: %v", err))
+	if err := retry("cask upgrade", func() error { return brew.UpgradeCask(toUpgradeCask, greedy, cfg.GreedyCasks, opts.Verbose) }); err != nil {
+		fail(fmt.Sprintf("cask upgrade failed: %v", err))
 		notifyFailure(cfg, "cask upgrade failed", err)
+	} else {
+		clearPending(&st, "cask", toUpgradeCask)
+		runPackageHooks(ctx, cfg, &st, res.Outdated, "cask", toUpgradeCask)
 	}
 
+	track("brew upgrade", started)
 	st.LastUpdateAt = ptrTime(time.Now())
-	st.LastCheckAt = ptrTime(time.Now())
-	notifyUpdates(cfg, res.Outdated, "Updated", false)
+	markChecked(&st, opts.Type, time.Now())
+	notifyUpdates(cfg, res.Outdated, "Updated", false, 0)
 
 	return res, cfg, st, nil
 }
 
+const brewPollInterval = 5 * time.Second
+
+// reports whether brew is still running after waiting up to wait for it to exit
+func brewStillRunning(ctx context.Context, wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for {
+		running, err := brew.HasRunningBrew()
+		if err != nil || !running {
+			return false
+		}
+		if !time.Now().Before(deadline) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(min(brewPollInterval, time.Until(deadline))):
+		}
+	}
+}
+
+func previewUpgrades(formulae []string, casks []string, greedy bool, greedyCasks []string) ([]string, error) {
+	preview, err := brew.UpgradeDryRun(formulae, false, greedy, nil)
+	if err != nil {
+		return nil, err
+	}
+	caskPreview, err := brew.UpgradeDryRun(casks, true, greedy, greedyCasks)
+	if err != nil {
+		return preview, err
+	}
+	preview = append(preview, caskPreview...)
+	sort.Strings(preview)
+	return preview, nil
+}
+
+func UnknownItems(cfg config.Config) ([]config.WatchItem, error) {
+	formulae, casks, err := brew.ListInstalled()
+	if err != nil {
+		return nil, err
+	}
+	unknown := []config.WatchItem{}
+	for _, item := range cfg.Watchlist {
+		if _, _, ok := installedVersion(formulae, casks, item); !ok {
+			unknown = append(unknown, item)
+		}
+	}
+	return unknown, nil
+}
+
 type fetchResult struct {
-	item        config.WatchItem
-	latest      string
-	scheme      int
-	etag        string
-	notModified bool
-	err         error
+	item         config.WatchItem
+	latest       string
+	scheme       int
+	etag         string
+	lastModified string
+	homepage     string
+	url          string
+	notModified  bool
+	err          error
+	elapsed      time.Duration
+	retries      int
+}
+
+type fetchOptions struct {
+	fresh      map[string]bool
+	noETags    bool
+	timeout    time.Duration
+	maxErrors  int
+	workers    int
+	hostLimits map[string]int
+	limit      *adaptiveLimit
+}
+
+const maxAutoWorkers = 16
+
+// two requests in flight per CPU, no more than there are packages
+func autoWorkers(items int) int {
+	return max(1, min(2*runtime.NumCPU(), maxAutoWorkers, items))
+}
+
+// adaptiveLimit caps requests in flight and halves the cap whenever the
+// server answers 429, so a run backs off instead of collecting errors
+type adaptiveLimit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newAdaptiveLimit(n int) *adaptiveLimit {
+	l := &adaptiveLimit{limit: n}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *adaptiveLimit) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimit) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+func (l *adaptiveLimit) throttle() {
+	l.mu.Lock()
+	l.limit = max(1, l.limit/2)
+	l.mu.Unlock()
+}
+
+// defaults, then config, then flags; later entries win per host
+func hostConcurrency(layers ...map[string]int) map[string]int {
+	limits := make(map[string]int, len(config.DefaultHostConcurrency))
+	for host, n := range config.DefaultHostConcurrency {
+		limits[host] = n
+	}
+	for _, layer := range layers {
+		for host, n := range layer {
+			limits[host] = n
+		}
+	}
+	return limits
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
 }
 
-func fetchLatest(ctx context.Context, client *api.Client, items []config.WatchItem, st *config.State) []fetchResult {
+func fetchLatest(ctx context.Context, client *api.Client, items []config.WatchItem, st *config.State, fo fetchOptions) ([]fetchResult, bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	jobs := make(chan config.WatchItem)
 	results := make(chan fetchResult)
-	workers := 4
+	// hosts without a limit are bounded only by the worker count
+	sems := make(map[string]chan struct{}, len(fo.hostLimits))
+	for host, n := range fo.hostLimits {
+		sems[host] = make(chan struct{}, n)
+	}
 	var wg sync.WaitGroup
-	wg.Add(workers)
-	for range workers {
+	wg.Add(fo.workers)
+	for range fo.workers {
 		go func() {
 			defer wg.Done()
 			for item := range jobs {
-				url := api.URLFor(item)
-				etag := st.ETagCache[url]
-				latest, newETag, notModified, err := client.FetchLatest(ctx, item, etag)
-				results <- fetchResult{item: item, latest: latest.Version, scheme: latest.Scheme, etag: newETag, notModified: notModified, err: err}
+				itemURL := api.URLFor(item)
+				cached := api.Validators{ETag: st.ETagCache[itemURL], LastModified: st.LastModified[itemURL]}
+				if fo.noETags || fo.fresh[config.WatchKey(item.Name, item.Type)] {
+					cached = api.Validators{}
+				}
+				sem := sems[hostOf(itemURL)]
+				if sem != nil {
+					select {
+					case sem <- struct{}{}:
+					case <-ctx.Done():
+						results <- fetchResult{item: item, err: ctx.Err()}
+						continue
+					}
+				}
+				if fo.limit != nil {
+					fo.limit.acquire()
+				}
+				r := fetchOne(ctx, client, item, cached, fo.timeout)
+				if fo.limit != nil {
+					if api.IsRateLimited(r.err) {
+						fo.limit.throttle()
+					}
+					fo.limit.release()
+				}
+				if sem != nil {
+					<-sem
+				}
+				results <- r
 			}
 		}()
 	}
@@ -228,37 +843,276 @@ func fetchLatest(ctx context.Context, client *api.Client, items []config.WatchIt
 	}()
 
 	out := make([]fetchResult, 0, len(items))
+	failures := 0
+	aborted := false
 	for r := range results {
 		out = append(out, r)
+		if fo.maxErrors <= 0 || aborted || failures < 0 {
+			continue
+		}
+		if !api.IsNetworkError(r.err) {
+			// any other outcome proves the network works; disarm the breaker
+			failures = -1
+			continue
+		}
+		failures++
+		if failures >= fo.maxErrors {
+			aborted = true
+			cancel()
+		}
+	}
+	return out, aborted
+}
+
+func sortOutdated(items []OutdatedItem) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].Item, items[j].Item
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Name < b.Name
+	})
+}
+
+// Simulate maps a name or type:name to a fake latest version
+func simulatedItems(cfg config.Config, simulate map[string]string) []config.WatchItem {
+	items := []config.WatchItem{}
+	for _, item := range cfg.Watchlist {
+		if _, ok := simulatedVersion(item, simulate); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func simulateLatest(items []config.WatchItem, simulate map[string]string) []fetchResult {
+	results := make([]fetchResult, 0, len(items))
+	for _, item := range items {
+		v, _ := simulatedVersion(item, simulate)
+		results = append(results, fetchResult{item: item, latest: v})
+	}
+	return results
+}
+
+func simulatedVersion(item config.WatchItem, simulate map[string]string) (string, bool) {
+	if v, ok := simulate[config.WatchKey(item.Name, item.Type)]; ok {
+		return v, true
+	}
+	v, ok := simulate[item.Name]
+	return v, ok
+}
+
+const retryBase = 5 * time.Minute
+
+// failed fetches retry after 5m, 10m, 20m... but never later than the
+// package's own interval
+func retryDelay(failures int, interval time.Duration) time.Duration {
+	delay := retryBase << min(failures-1, 10)
+	return min(delay, interval)
+}
+
+func scheduleRetry(st *config.State, item config.WatchItem, now time.Time) {
+	key := config.WatchKey(item.Name, item.Type)
+	st.FetchFailures[key]++
+	delay := retryDelay(st.FetchFailures[key], time.Duration(item.IntervalMin)*time.Minute)
+	st.NextCheckAt[key] = now.Add(delay).Format(time.RFC3339)
+}
+
+// retry a 404 under the name brew resolves (renames, aliases)
+func resolveRenamed(ctx context.Context, client *api.Client, r fetchResult, timeout time.Duration) (fetchResult, bool) {
+	name, err := brew.CanonicalName(r.item.Name, r.item.Type)
+	if err != nil || name == "" || name == r.item.Name || name == r.item.ResolvedName {
+		return r, false
+	}
+	item := r.item
+	item.ResolvedName = name
+	resolved := fetchOne(ctx, client, item, api.Validators{}, timeout)
+	if resolved.err != nil {
+		return r, false
+	}
+	return resolved, true
+}
+
+func setResolvedName(cfg *config.Config, item config.WatchItem) {
+	key := config.WatchKey(item.Name, item.Type)
+	for i := range cfg.Watchlist {
+		if config.WatchKey(cfg.Watchlist[i].Name, cfg.Watchlist[i].Type) == key {
+			cfg.Watchlist[i].ResolvedName = item.ResolvedName
+		}
+	}
+}
+
+func fetchOne(ctx context.Context, client *api.Client, item config.WatchItem, cached api.Validators, timeout time.Duration) (r fetchResult) {
+	// one bad package must not take down the whole check
+	defer func() {
+		if p := recover(); p != nil {
+			r = fetchResult{item: item, err: fmt.Errorf("panic: %v", p)}
+		}
+	}()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	started := time.Now()
+	latest, validators, notModified, err := client.FetchLatest(ctx, item, cached)
+	retries := latest.Retries
+	if err != nil {
+		retries = api.Retries(err)
+	}
+	return fetchResult{
+		item:         item,
+		latest:       latest.Version,
+		scheme:       latest.Scheme,
+		etag:         validators.ETag,
+		lastModified: validators.LastModified,
+		homepage:     latest.Homepage,
+		url:          latest.URL,
+		notModified:  notModified,
+		err:          err,
+		elapsed:      time.Since(started),
+		retries:      retries,
 	}
-	return out
 }
 
-func dueItems(cfg config.Config, st config.State, now time.Time) []config.WatchItem {
+func fetchTiming(results []fetchResult) FetchTiming {
+	if len(results) == 0 {
+		return FetchTiming{}
+	}
+	ft := FetchTiming{Min: results[0].elapsed}
+	var total time.Duration
+	for _, r := range results {
+		ft.Min = min(ft.Min, r.elapsed)
+		ft.Max = max(ft.Max, r.elapsed)
+		total += r.elapsed
+		ft.Retries += r.retries
+	}
+	ft.Avg = total / time.Duration(len(results))
+	return ft
+}
+
+func dueItems(cfg config.Config, st config.State, now time.Time, force map[string]bool) []config.WatchItem {
 	items := make([]config.WatchItem, 0)
 	for _, item := range cfg.Watchlist {
 		if item.IntervalMin == 0 {
 			item.IntervalMin = config.DefaultIntervalMin
 		}
-		key := config.WatchKey(item.Name, item.Type)
-		nextStr, ok := st.NextCheckAt[key]
-		if !ok && key != item.Name {
-			nextStr, ok = st.NextCheckAt[item.Name]
-		}
-		if !ok || nextStr == "" {
+		if force[config.WatchKey(item.Name, item.Type)] {
 			items = append(items, item)
 			continue
 		}
-		nextTime, err := time.Parse(time.RFC3339, nextStr)
-		if err != nil {
+		if _, due := NextCheck(item, st, now); due {
 			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// NextCheck returns the scheduled next check of item (zero if never scheduled)
+// and whether a check at now would include it.
+func NextCheck(item config.WatchItem, st config.State, now time.Time) (time.Time, bool) {
+	if item.IntervalMin == 0 {
+		item.IntervalMin = config.DefaultIntervalMin
+	}
+	key := config.WatchKey(item.Name, item.Type)
+	nextStr, ok := st.NextCheckAt[key]
+	if !ok && key != item.Name {
+		nextStr, ok = st.NextCheckAt[item.Name]
+	}
+	if !ok || nextStr == "" {
+		return time.Time{}, true
+	}
+	nextTime, err := time.Parse(time.RFC3339, nextStr)
+	if err != nil {
+		return time.Time{}, true
+	}
+	// a next check further out than one interval means the clock went backwards
+	due := !now.Before(nextTime) || nextTime.Sub(now) > time.Duration(item.IntervalMin)*time.Minute
+	return nextTime, due
+}
+
+// a long gap since the last tick means the machine slept through its schedule
+func resumed(st config.State, now time.Time, gap time.Duration) bool {
+	if gap <= 0 || st.LastCheckAt == nil {
+		return false
+	}
+	return now.Sub(*st.LastCheckAt) > gap
+}
+
+func allKeys(cfg config.Config) map[string]bool {
+	keys := make(map[string]bool, len(cfg.Watchlist))
+	for _, item := range cfg.Watchlist {
+		keys[config.WatchKey(item.Name, item.Type)] = true
+	}
+	return keys
+}
+
+func maxVersionAge(cfg config.Config, opts Options) time.Duration {
+	if opts.MaxAge > 0 {
+		return opts.MaxAge
+	}
+	return time.Duration(cfg.MaxVersionAgeMin) * time.Minute
+}
+
+func staleKeys(cfg config.Config, st config.State, now time.Time, maxAge time.Duration) map[string]bool {
+	stale := make(map[string]bool)
+	if maxAge <= 0 {
+		return stale
+	}
+	for _, item := range cfg.Watchlist {
+		key := config.WatchKey(item.Name, item.Type)
+		lastStr, ok := st.LastFetchAt[key]
+		if !ok {
+			stale[key] = true
 			continue
 		}
-		if !now.Before(nextTime) {
-			items = append(items, item)
+		last, err := time.Parse(time.RFC3339, lastStr)
+		if err != nil || now.Sub(last) > maxAge {
+			stale[key] = true
 		}
 	}
-	return items
+	return stale
+}
+
+// takeBudget refills the persisted token bucket at perHour tokens an hour,
+// holding at most an hour's worth, and takes up to want tokens from it.
+// Every check process shares the bucket through state.
+func takeBudget(st *config.State, perHour int, want int, now time.Time) int {
+	capacity := float64(perHour)
+	b := st.APIBudget
+	if b == nil {
+		b = &config.Budget{Tokens: capacity, RefilledAt: now}
+		st.APIBudget = b
+	}
+	if elapsed := now.Sub(b.RefilledAt); elapsed > 0 {
+		b.Tokens = min(capacity, b.Tokens+elapsed.Hours()*capacity)
+	}
+	b.Tokens = min(b.Tokens, capacity)
+	b.RefilledAt = now
+	n := min(want, int(b.Tokens))
+	b.Tokens -= float64(n)
+	return n
+}
+
+// keep the most overdue items when a run is capped; the rest stay due
+func capDue(items []config.WatchItem, st config.State, max int) []config.WatchItem {
+	if max <= 0 || len(items) <= max {
+		return items
+	}
+	// never scheduled parses as the zero time and sorts first; offsets can
+	// differ between entries, so compare instants rather than strings
+	next := func(item config.WatchItem) time.Time {
+		key := config.WatchKey(item.Name, item.Type)
+		v, ok := st.NextCheckAt[key]
+		if !ok {
+			v = st.NextCheckAt[item.Name]
+		}
+		t, _ := time.Parse(time.RFC3339, v)
+		return t
+	}
+	sorted := append([]config.WatchItem(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool { return next(sorted[i]).Before(next(sorted[j])) })
+	return sorted[:max]
 }
 
 func splitByType(outdated []OutdatedItem, cfg config.Config) ([]string, []string) {
@@ -283,18 +1137,168 @@ func splitByType(outdated []OutdatedItem, cfg config.Config) ([]string, []string
 	return formulae, casks
 }
 
-func notifyUpdates(cfg config.Config, items []OutdatedItem, action string, forceAll bool) {
+// auto upgrades wait until the release has been latest for the grace period
+func holdNewReleases(items []OutdatedItem, cfg config.Config, st config.State, now time.Time, grace time.Duration) ([]OutdatedItem, []OutdatedItem) {
+	if grace <= 0 {
+		return items, nil
+	}
+	ready := make([]OutdatedItem, 0, len(items))
+	held := []OutdatedItem{}
+	for _, item := range items {
+		policy := item.Item.Policy
+		if policy == "" {
+			policy = cfg.DefaultPolicy
+		}
+		if policy == "auto" {
+			key := config.WatchKey(item.Item.Name, item.Item.Type)
+			seen, err := time.Parse(time.RFC3339, st.VersionFirstSeen[config.VersionKey(key, item.Latest)])
+			if err != nil || now.Sub(seen) < grace {
+				held = append(held, item)
+				continue
+			}
+		}
+		ready = append(ready, item)
+	}
+	return ready, held
+}
+
+func freshHeld(st *config.State, held []OutdatedItem) []OutdatedItem {
+	fresh := make([]OutdatedItem, 0, len(held))
+	for _, item := range held {
+		key := config.WatchKey(item.Item.Name, item.Item.Type)
+		if st.Held[key] != item.Latest {
+			st.Held[key] = item.Latest
+			fresh = append(fresh, item)
+		}
+	}
+	return fresh
+}
+
+func filterChanged(items []OutdatedItem, changed map[string]bool) []OutdatedItem {
+	out := make([]OutdatedItem, 0, len(items))
+	for _, item := range items {
+		if changed[config.WatchKey(item.Item.Name, item.Item.Type)] {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func filterPolicy(items []OutdatedItem, cfg config.Config, policy string) []OutdatedItem {
+	out := make([]OutdatedItem, 0, len(items))
+	for _, item := range items {
+		p := item.Item.Policy
+		if p == "" {
+			p = cfg.DefaultPolicy
+		}
+		if p == policy {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func DuplicateNames(cfg config.Config) []string {
+	types := map[string]map[string]bool{}
+	for _, item := range cfg.Watchlist {
+		if types[item.Name] == nil {
+			types[item.Name] = map[string]bool{}
+		}
+		types[item.Name][item.Type] = true
+	}
+	names := []string{}
+	for name, t := range types {
+		if t["formula"] && t["cask"] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// drop the non-preferred side when a name is outdated as both formula and cask
+func preferType(formulae []string, casks []string, prefer string) ([]string, []string) {
+	if prefer == "" {
+		return formulae, casks
+	}
+	inFormula := map[string]bool{}
+	for _, name := range formulae {
+		inFormula[name] = true
+	}
+	inCask := map[string]bool{}
+	for _, name := range casks {
+		inCask[name] = true
+	}
+	keep := func(names []string, other map[string]bool) []string {
+		out := make([]string, 0, len(names))
+		for _, name := range names {
+			if !other[name] {
+				out = append(out, name)
+			}
+		}
+		return out
+	}
+	if prefer == "cask" {
+		return keep(formulae, inCask), casks
+	}
+	return formulae, keep(casks, inFormula)
+}
+
+func notifyUpdates(cfg config.Config, items []OutdatedItem, action string, forceAll bool, threshold int) {
 	n := notify.New(cfg.NotifyMethod)
+	eligible := make([]OutdatedItem, 0, len(items))
 	for _, item := range items {
 		policy := item.Item.Policy
 		if policy == "" {
 			policy = cfg.DefaultPolicy
 		}
 		if forceAll || policy == "notify" || action == "Updated" {
-			msg := fmt.Sprintf("%s %s → %s", item.Item.Name, item.Installed, item.Latest)
-			_ = n.Notify("brew-updater", msg, "brew-updater upgrade "+item.Item.Name)
+			eligible = append(eligible, item)
+		}
+	}
+	if len(eligible) == 0 {
+		return
+	}
+	if threshold > 1 {
+		if len(eligible) < threshold {
+			return
+		}
+		msg := fmt.Sprintf("%d updates pending", len(eligible))
+		_ = n.Notify("brew-updater", msg, "brew-updater status")
+		return
+	}
+	// validated at config load; a template that still fails falls back to the default text
+	titleTmpl, _ := config.NotifyTemplate("notify_title_template", cfg.NotifyTitleTemplate)
+	bodyTmpl, _ := config.NotifyTemplate("notify_message_template", cfg.NotifyMessageTemplate)
+	for _, item := range eligible {
+		fields := config.NotifyFields{
+			Name:      item.Item.Name,
+			Type:      item.Item.Type,
+			Installed: item.Installed,
+			Latest:    item.Latest,
+			Action:    action,
+		}
+		m := notify.Message{
+			Title:   render(titleTmpl, fields, "brew-updater"),
+			Body:    render(bodyTmpl, fields, fmt.Sprintf("%s %s → %s", item.Item.Name, item.Installed, item.Latest)),
+			Execute: "brew-updater upgrade " + item.Item.Name,
 		}
+		if cfg.NotifyOpenHomepage {
+			m.Open = item.Homepage
+		}
+		_ = n.Send(m)
+	}
+}
+
+func render(t *template.Template, fields config.NotifyFields, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, fields); err != nil {
+		return fallback
 	}
+	return b.String()
 }
 
 func notifyFailure(cfg config.Config, title string, err error) {
@@ -303,13 +1307,167 @@ func notifyFailure(cfg config.Config, title string, err error) {
 	_ = n.Notify("brew-updater failed", title+": "+msg, "brew-updater status")
 }
 
+// watchlist changes made behind the user's back deserve a banner
+func notifyRemoved(cfg config.Config, removed []config.WatchItem) {
+	if len(removed) == 0 {
+		return
+	}
+	names := make([]string, 0, len(removed))
+	for _, item := range removed {
+		names = append(names, item.Name)
+	}
+	sort.Strings(names)
+	n := notify.New(cfg.NotifyMethod)
+	_ = n.Notify("brew-updater", "No longer installed, stopped watching: "+strings.Join(names, ", "), "brew-updater list")
+}
+
+const errorNotifyCooldown = time.Hour
+
+// one summary per cooldown so a persistent failure doesn't notify every tick
+func notifyErrors(cfg config.Config, st *config.State, count int, now time.Time) {
+	if count == 0 {
+		return
+	}
+	if st.LastErrorNotifyAt != nil && now.Sub(*st.LastErrorNotifyAt) < errorNotifyCooldown {
+		return
+	}
+	n := notify.New(cfg.NotifyMethod)
+	noun := "errors"
+	if count == 1 {
+		noun = "error"
+	}
+	_ = n.Notify("brew-updater", fmt.Sprintf("%d %s this run, run brew-updater status", count, noun), "brew-updater status")
+	st.LastErrorNotifyAt = ptrTime(now)
+}
+
+var repeatedError = regexp.MustCompile(`^(.*) \(x(\d+), last [^)]*\)$`)
+
+// collapse repeats into "<msg> (xN, last 15:04)" and move them to the end
 func appendError(st *config.State, msg string) {
+	for i, prev := range st.LastErrors {
+		count := 1
+		if m := repeatedError.FindStringSubmatch(prev); m != nil {
+			prev = m[1]
+			count, _ = strconv.Atoi(m[2])
+		}
+		if prev != msg {
+			continue
+		}
+		st.LastErrors = append(st.LastErrors[:i], st.LastErrors[i+1:]...)
+		msg = fmt.Sprintf("%s (x%d, last %s)", msg, count+1, time.Now().Format("15:04"))
+		break
+	}
 	st.LastErrors = append(st.LastErrors, msg)
+	st.LastRunErrors++
 	if len(st.LastErrors) > 20 {
 		st.LastErrors = st.LastErrors[len(st.LastErrors)-20:]
 	}
 }
 
+func runPackageHooks(ctx context.Context, cfg config.Config, st *config.State, items []OutdatedItem, typ string, names []string) {
+	if len(cfg.PackageHooks) == 0 {
+		return
+	}
+	upgraded := map[string]bool{}
+	for _, name := range names {
+		upgraded[name] = true
+	}
+	for _, item := range items {
+		if item.Item.Type != typ || !upgraded[item.Item.Name] {
+			continue
+		}
+		command, ok := cfg.PackageHooks[config.WatchKey(item.Item.Name, item.Item.Type)]
+		if !ok {
+			command, ok = cfg.PackageHooks[item.Item.Name]
+		}
+		if !ok || command == "" {
+			continue
+		}
+		err := hook.Run(ctx, command, map[string]string{
+			"BREW_UPDATER_PACKAGE":     item.Item.Name,
+			"BREW_UPDATER_TYPE":        item.Item.Type,
+			"BREW_UPDATER_OLD_VERSION": item.Installed,
+			"BREW_UPDATER_NEW_VERSION": item.Latest,
+		}, time.Duration(cfg.HookTimeoutSec)*time.Second)
+		if err != nil {
+			appendError(st, fmt.Sprintf("%s: %v", item.Item.Name, err))
+		}
+	}
+}
+
+func clearPending(st *config.State, typ string, names []string) {
+	for _, name := range names {
+		delete(st.Pending, config.WatchKey(name, typ))
+		delete(st.DeferredCasks, config.WatchKey(name, typ))
+		delete(st.TooLarge, config.WatchKey(name, typ))
+		delete(st.Held, config.WatchKey(name, typ))
+	}
+}
+
+// deferred casks that are still pending and not already part of this run
+func deferredCasks(cfg config.Config, st config.State, outdated []OutdatedItem) []OutdatedItem {
+	if len(st.DeferredCasks) == 0 {
+		return nil
+	}
+	inRun := make(map[string]bool, len(outdated))
+	for _, item := range outdated {
+		inRun[config.WatchKey(item.Item.Name, item.Item.Type)] = true
+	}
+	items := []OutdatedItem{}
+	for _, w := range cfg.Watchlist {
+		key := config.WatchKey(w.Name, w.Type)
+		if _, ok := st.DeferredCasks[key]; !ok || inRun[key] {
+			continue
+		}
+		if p, ok := st.Pending[key]; ok {
+			items = append(items, OutdatedItem{Item: w, Installed: p.Installed, Latest: p.Latest, Homepage: p.Homepage, URL: p.URL})
+		}
+	}
+	return items
+}
+
+func inWindow(window string, now time.Time) bool {
+	if window == "" {
+		return false
+	}
+	start, end, err := config.ParseWindow(window)
+	if err != nil {
+		return false
+	}
+	y, m, d := now.Date()
+	t := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if start <= end {
+		return t >= start && t < end
+	}
+	return t >= start || t < end
+}
+
+func markChecked(st *config.State, typ string, t time.Time) {
+	switch typ {
+	case "formula":
+		st.LastCheckFormulaAt = ptrTime(t)
+	case "cask":
+		st.LastCheckCaskAt = ptrTime(t)
+	default:
+		st.LastCheckFormulaAt = ptrTime(t)
+		st.LastCheckCaskAt = ptrTime(t)
+	}
+	st.LastCheckAt = ptrTime(t)
+}
+
+func filterType(items []config.WatchItem, typ string) []config.WatchItem {
+	if typ == "" || typ == "all" {
+		return items
+	}
+	out := make([]config.WatchItem, 0, len(items))
+	for _, item := range items {
+		if item.Type == typ {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func ptrTime(t time.Time) *time.Time {
 	return &t
 }
@@ -365,6 +1523,35 @@ func normalizeStateKeys(cfg config.Config, st *config.State) {
 	}
 }
 
+func MigrateState(cfg config.Config, st *config.State) []string {
+	normalizeStateKeys(cfg, st)
+	migrated := []string{}
+	for _, item := range cfg.Watchlist {
+		key := config.WatchKey(item.Name, item.Type)
+		if key == item.Name {
+			continue
+		}
+		moved := false
+		if _, ok := st.NextCheckAt[item.Name]; ok {
+			delete(st.NextCheckAt, item.Name)
+			moved = true
+		}
+		if _, ok := st.LastVersions[item.Name]; ok {
+			delete(st.LastVersions, item.Name)
+			moved = true
+		}
+		if _, ok := st.LastSchemes[item.Name]; ok {
+			delete(st.LastSchemes, item.Name)
+			moved = true
+		}
+		if moved {
+			migrated = append(migrated, item.Name+" -> "+key)
+		}
+	}
+	sort.Strings(migrated)
+	return migrated
+}
+
 func cleanupStateKeys(cfg config.Config, st *config.State) {
 	watched := make(map[string]bool)
 	for _, item := range cfg.Watchlist {
@@ -387,6 +1574,133 @@ func cleanupStateKeys(cfg config.Config, st *config.State) {
 			delete(st.LastSchemes, key)
 		}
 	}
+	for key := range st.LastFetchAt {
+		if !watched[key] {
+			delete(st.LastFetchAt, key)
+		}
+	}
+	for key := range st.Pending {
+		if !watched[key] {
+			delete(st.Pending, key)
+		}
+	}
+	for key := range st.Baselines {
+		if !watched[key] {
+			delete(st.Baselines, key)
+		}
+	}
+	for key := range st.FetchFailures {
+		if !watched[key] {
+			delete(st.FetchFailures, key)
+		}
+	}
+	for key := range st.History {
+		if !watched[key] {
+			delete(st.History, key)
+		}
+	}
+	for key := range st.DeferredCasks {
+		if _, pending := st.Pending[key]; !watched[key] || !pending {
+			delete(st.DeferredCasks, key)
+		}
+	}
+	for key := range st.TooLarge {
+		if _, pending := st.Pending[key]; !watched[key] || !pending {
+			delete(st.TooLarge, key)
+		}
+	}
+	for key := range st.Held {
+		if _, pending := st.Pending[key]; !watched[key] || !pending {
+			delete(st.Held, key)
+		}
+	}
+}
+
+// keep first-seen times only for each package's current latest version
+func pruneFirstSeen(cfg config.Config, st *config.State) {
+	current := make(map[string]bool)
+	for _, item := range cfg.Watchlist {
+		key := config.WatchKey(item.Name, item.Type)
+		if v, ok := st.LastVersions[key]; ok {
+			current[config.VersionKey(key, v)] = true
+		}
+	}
+	for k := range st.VersionFirstSeen {
+		if !current[k] {
+			delete(st.VersionFirstSeen, k)
+		}
+	}
+}
+
+// casks whose download is larger than max; unknown sizes do not block an upgrade
+func splitBySize(ctx context.Context, client *api.Client, outdated []OutdatedItem, casks []string, max int64, timeout time.Duration) ([]string, []string) {
+	urls := make(map[string]string, len(outdated))
+	for _, item := range outdated {
+		if item.Item.Type == "cask" {
+			urls[item.Item.Name] = item.URL
+		}
+	}
+	var ok, large []string
+	for _, name := range casks {
+		if urls[name] == "" {
+			ok = append(ok, name)
+			continue
+		}
+		sizeCtx, cancel := context.WithTimeout(ctx, timeout)
+		size, err := client.DownloadSize(sizeCtx, urls[name])
+		cancel()
+		if err == nil && size > max {
+			large = append(large, name)
+		} else {
+			ok = append(ok, name)
+		}
+	}
+	return ok, large
+}
+
+// keys (type:name) of items that brew outdated also lists
+func brewConfirmed(items []OutdatedItem, greedy bool, greedyCasks []string) (map[string]bool, error) {
+	formulae, casks := []string{}, []string{}
+	for _, item := range items {
+		if item.Item.Type == "cask" {
+			casks = append(casks, item.Item.Name)
+		} else {
+			formulae = append(formulae, item.Item.Name)
+		}
+	}
+	confirmed := make(map[string]bool)
+	if len(formulae) > 0 {
+		names, err := brew.OutdatedFormula(formulae)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			confirmed[config.WatchKey(name, "formula")] = true
+		}
+	}
+	if len(casks) > 0 {
+		names, err := brew.OutdatedCask(casks, greedy, greedyCasks)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			confirmed[config.WatchKey(name, "cask")] = true
+		}
+	}
+	return confirmed, nil
+}
+
+func splitConfirmed(items []OutdatedItem, confirmed map[string]bool) ([]OutdatedItem, []OutdatedItem) {
+	kept := make([]OutdatedItem, 0, len(items))
+	dropped := []OutdatedItem{}
+	for _, item := range items {
+		if confirmed[config.WatchKey(item.Item.Name, item.Item.Type)] {
+			kept = append(kept, item)
+		} else {
+			dropped = append(dropped, item)
+		}
+	}
+	return kept, dropped
 }
 
 func filterOutdated(items []OutdatedItem, formulas []string, casks []string) []OutdatedItem {
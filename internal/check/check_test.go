@@ -0,0 +1,353 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samzong/brew-updater/internal/api"
+	"github.com/samzong/brew-updater/internal/config"
+)
+
+func outdatedItem(name, typ, installed, latest string) OutdatedItem {
+	return OutdatedItem{Item: config.WatchItem{Name: name, Type: typ}, Installed: installed, Latest: latest}
+}
+
+func names(items []OutdatedItem) []string {
+	out := []string{}
+	for _, item := range items {
+		out = append(out, config.WatchKey(item.Item.Name, item.Item.Type))
+	}
+	return out
+}
+
+func TestSplitConfirmed(t *testing.T) {
+	items := []OutdatedItem{
+		outdatedItem("git", "formula", "2.44.0", "2.45.0"),
+		// API ahead of local metadata: brew outdated does not list it yet
+		outdatedItem("node", "formula", "21.7.0", "22.0.0"),
+		outdatedItem("firefox", "cask", "124.0", "125.0"),
+		// same name confirmed only as the other type
+		outdatedItem("docker", "cask", "4.28.0", "4.29.0"),
+	}
+	confirmed := map[string]bool{
+		"formula:git":     true,
+		"cask:firefox":    true,
+		"formula:docker":  true,
+		"formula:unwatch": true,
+	}
+	kept, disputed := splitConfirmed(items, confirmed)
+	if got, want := names(kept), []string{"formula:git", "cask:firefox"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept = %v, want %v", got, want)
+	}
+	if got, want := names(disputed), []string{"formula:node", "cask:docker"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("disputed = %v, want %v", got, want)
+	}
+	// the API version is kept for display
+	if kept[0].Latest != "2.45.0" {
+		t.Errorf("kept latest = %q, want API version", kept[0].Latest)
+	}
+}
+
+func TestSplitConfirmedNothingConfirmed(t *testing.T) {
+	items := []OutdatedItem{outdatedItem("git", "formula", "2.44.0", "2.45.0")}
+	kept, disputed := splitConfirmed(items, map[string]bool{})
+	if len(kept) != 0 || len(disputed) != 1 {
+		t.Errorf("kept=%d disputed=%d, want 0 and 1", len(kept), len(disputed))
+	}
+}
+
+func TestResumed(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	tests := []struct {
+		name string
+		last *time.Time
+		gap  time.Duration
+		want bool
+	}{
+		{"disabled", at(time.Hour), 0, false},
+		{"never checked", nil, 5 * time.Minute, false},
+		{"regular tick", at(time.Minute), 5 * time.Minute, false},
+		{"after sleep", at(40 * time.Minute), 5 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := config.DefaultState()
+			st.LastCheckAt = tt.last
+			if got := resumed(st, now, tt.gap); got != tt.want {
+				t.Errorf("resumed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDueItemsClockSkew(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cfg := config.DefaultConfig()
+	cfg.Watchlist = []config.WatchItem{
+		{Name: "due", Type: "formula", IntervalMin: 60},
+		{Name: "later", Type: "formula", IntervalMin: 60},
+		// scheduled a day out on a 1h interval: the clock went backwards
+		{Name: "skewed", Type: "formula", IntervalMin: 60},
+		{Name: "new", Type: "formula", IntervalMin: 60},
+	}
+	st := config.DefaultState()
+	st.NextCheckAt["formula:due"] = now.Add(-time.Minute).Format(time.RFC3339)
+	st.NextCheckAt["formula:later"] = now.Add(30 * time.Minute).Format(time.RFC3339)
+	st.NextCheckAt["formula:skewed"] = now.Add(24 * time.Hour).Format(time.RFC3339)
+
+	got := namesFromItems(dueItems(cfg, st, now, nil))
+	if want := []string{"due", "new", "skewed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("due = %v, want %v", got, want)
+	}
+	got = namesFromItems(dueItems(cfg, st, now, allKeys(cfg)))
+	if want := []string{"due", "later", "new", "skewed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("due after wake = %v, want %v", got, want)
+	}
+}
+
+func TestFetchOneRecoversPanic(t *testing.T) {
+	item := config.WatchItem{Name: "git", Type: "formula"}
+	// a nil client panics inside FetchLatest
+	r := fetchOne(context.Background(), nil, item, api.Validators{}, time.Second)
+	if r.err == nil || !strings.Contains(r.err.Error(), "panic") {
+		t.Fatalf("err = %v, want a recovered panic", r.err)
+	}
+	if r.item.Name != "git" {
+		t.Errorf("item = %q, want the failing package", r.item.Name)
+	}
+}
+
+func TestAppendErrorDedup(t *testing.T) {
+	st := config.DefaultState()
+	appendError(&st, "git: api status 503")
+	appendError(&st, "node: timeout")
+	appendError(&st, "git: api status 503")
+	appendError(&st, "git: api status 503")
+
+	if len(st.LastErrors) != 2 {
+		t.Fatalf("errors = %q, want 2 entries", st.LastErrors)
+	}
+	if st.LastErrors[0] != "node: timeout" {
+		t.Errorf("first = %q, want the untouched error", st.LastErrors[0])
+	}
+	// the repeated error moves to the end with its count
+	if got := st.LastErrors[1]; !strings.HasPrefix(got, "git: api status 503 (x3, last ") {
+		t.Errorf("last = %q, want a x3 repeat", got)
+	}
+
+	appendError(&st, "git: api status 503 (upstream)")
+	if len(st.LastErrors) != 3 {
+		t.Errorf("errors = %q, a different message must not collapse", st.LastErrors)
+	}
+}
+
+func TestAppendErrorCap(t *testing.T) {
+	st := config.DefaultState()
+	for i := range 25 {
+		appendError(&st, fmt.Sprintf("error %d", i))
+	}
+	if len(st.LastErrors) != 20 || st.LastErrors[0] != "error 5" {
+		t.Errorf("errors = %q, want the newest 20", st.LastErrors)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		failures int
+		interval time.Duration
+		want     time.Duration
+	}{
+		{1, day, 5 * time.Minute},
+		{2, day, 10 * time.Minute},
+		{3, day, 20 * time.Minute},
+		{4, day, 40 * time.Minute},
+		{10, day, day},
+		// capped by the package interval
+		{1, 2 * time.Minute, 2 * time.Minute},
+		{3, 15 * time.Minute, 15 * time.Minute},
+		// backoff tops out at 5m<<10 (about 3.5 days), so huge counts don't overflow
+		{11, 30 * day, 5 * time.Minute << 10},
+		{500, 30 * day, 5 * time.Minute << 10},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.failures, tt.interval); got != tt.want {
+			t.Errorf("retryDelay(%d, %s) = %s, want %s", tt.failures, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	st := config.DefaultState()
+	item := config.WatchItem{Name: "git", Type: "formula", IntervalMin: 60}
+	want := []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour}
+	for i, d := range want {
+		scheduleRetry(&st, item, now)
+		if got := st.NextCheckAt["formula:git"]; got != now.Add(d).Format(time.RFC3339) {
+			t.Errorf("failure %d: next check %s, want now+%s", i+1, got, d)
+		}
+	}
+	if st.FetchFailures["formula:git"] != len(want) {
+		t.Errorf("failures = %d, want %d", st.FetchFailures["formula:git"], len(want))
+	}
+}
+
+func TestSortOutdatedStable(t *testing.T) {
+	items := []OutdatedItem{
+		outdatedItem("node", "formula", "21.7.0", "22.0.0"),
+		outdatedItem("firefox", "cask", "124.0", "125.0"),
+		outdatedItem("docker", "formula", "26.0.0", "26.1.0"),
+		outdatedItem("docker", "cask", "4.28.0", "4.29.0"),
+		outdatedItem("git", "formula", "2.44.0", "2.45.0"),
+	}
+	want := []string{"cask:docker", "cask:firefox", "formula:docker", "formula:git", "formula:node"}
+	// completion order from the worker pool varies run to run
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 50 {
+		shuffled := append([]OutdatedItem(nil), items...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		sortOutdated(shuffled)
+		if got := names(shuffled); !reflect.DeepEqual(got, want) {
+			t.Fatalf("order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTakeBudget(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	st := config.DefaultState()
+
+	// a fresh bucket starts full
+	if got := takeBudget(&st, 60, 40, now); got != 40 {
+		t.Fatalf("first take = %d, want 40", got)
+	}
+	if got := takeBudget(&st, 60, 40, now); got != 20 {
+		t.Fatalf("second take = %d, want the remaining 20", got)
+	}
+	if got := takeBudget(&st, 60, 5, now); got != 0 {
+		t.Fatalf("empty bucket gave %d", got)
+	}
+	// refills at perHour per hour: 10 minutes is 10 tokens
+	if got := takeBudget(&st, 60, 40, now.Add(10*time.Minute)); got != 10 {
+		t.Errorf("after 10m = %d, want 10", got)
+	}
+	// never holds more than an hour's worth
+	if got := takeBudget(&st, 60, 500, now.Add(48*time.Hour)); got != 60 {
+		t.Errorf("after 2 days = %d, want capacity 60", got)
+	}
+	// a clock going backwards must not refill
+	if got := takeBudget(&st, 60, 5, now); got != 0 {
+		t.Errorf("after clock skew = %d, want 0", got)
+	}
+}
+
+func TestTakeBudgetLowersCapacity(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	st := config.DefaultState()
+	st.APIBudget = &config.Budget{Tokens: 500, RefilledAt: now}
+	if got := takeBudget(&st, 60, 100, now); got != 60 {
+		t.Errorf("take = %d, want 60 after api_requests_per_hour was lowered", got)
+	}
+}
+
+func TestCapDue(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	items := []config.WatchItem{
+		{Name: "a", Type: "formula"},
+		{Name: "b", Type: "formula"},
+		{Name: "c", Type: "cask"},
+		{Name: "d", Type: "formula"},
+	}
+	st := config.DefaultState()
+	st.NextCheckAt["formula:a"] = now.Add(-time.Minute).Format(time.RFC3339)
+	st.NextCheckAt["formula:b"] = now.Add(-time.Hour).Format(time.RFC3339)
+	st.NextCheckAt["cask:c"] = now.Add(-10 * time.Minute).Format(time.RFC3339)
+	// "d" was never scheduled, which sorts as most overdue
+
+	tests := []struct {
+		max  int
+		want []string
+	}{
+		{0, []string{"a", "b", "c", "d"}},
+		{10, []string{"a", "b", "c", "d"}},
+		{1, []string{"d"}},
+		{3, []string{"b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		got := namesFromItems(capDue(items, st, tt.max))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("capDue(max=%d) = %v, want %v", tt.max, got, tt.want)
+		}
+	}
+	if items[0].Name != "a" {
+		t.Error("capDue reordered its input")
+	}
+}
+
+func TestCapDueMixedOffsets(t *testing.T) {
+	items := []config.WatchItem{
+		{Name: "a", Type: "formula"},
+		{Name: "b", Type: "formula"},
+	}
+	st := config.DefaultState()
+	// the repeated hour when DST ends: a is the earlier instant but the
+	// later string
+	st.NextCheckAt["formula:a"] = "2024-11-03T01:50:00-07:00"
+	st.NextCheckAt["formula:b"] = "2024-11-03T01:10:00-08:00"
+	if got := namesFromItems(capDue(items, st, 1)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("capDue = %v, want the earlier instant a", got)
+	}
+}
+
+func TestRunResetsRunErrors(t *testing.T) {
+	st := config.DefaultState()
+	appendError(&st, "git: api status 503")
+	if st.LastRunErrors != 1 {
+		t.Fatalf("run errors = %d, want 1", st.LastRunErrors)
+	}
+
+	// a clean run afterwards: nothing to fetch, nothing fails
+	noneInstalled := func() (map[string]string, map[string]string, error) {
+		return map[string]string{}, map[string]string{}, nil
+	}
+	_, _, st, err := run(context.Background(), config.DefaultConfig(), st, Options{ListInstalled: noneInstalled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastRunErrors != 0 {
+		t.Errorf("run errors = %d, want 0 after a clean run", st.LastRunErrors)
+	}
+	if len(st.LastErrors) != 1 {
+		t.Errorf("errors = %q, history must survive the reset", st.LastErrors)
+	}
+}
+
+func TestFreshHeld(t *testing.T) {
+	st := config.DefaultState()
+	held := []OutdatedItem{
+		outdatedItem("git", "formula", "2.44.0", "2.45.0"),
+		outdatedItem("firefox", "cask", "124.0", "125.0"),
+	}
+	if got := names(freshHeld(&st, held)); !reflect.DeepEqual(got, []string{"formula:git", "cask:firefox"}) {
+		t.Fatalf("first run = %v, want both", got)
+	}
+	// still inside the grace period on the next tick
+	if got := freshHeld(&st, held); len(got) != 0 {
+		t.Errorf("second run = %v, want no repeat", names(got))
+	}
+	// a newer release during the hold is announced again
+	held[0].Latest = "2.45.1"
+	if got := names(freshHeld(&st, held)); !reflect.DeepEqual(got, []string{"formula:git"}) {
+		t.Errorf("new version = %v, want formula:git", got)
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 )
 
@@ -14,32 +20,88 @@ const (
 	DefaultTickInterval = 60
 	DefaultIntervalMin  = 5
 	MinIntervalMin      = 1
-	MaxIntervalMin      = 1440
+	MaxIntervalMin      = 43200
 	DefaultPolicy       = "auto"
 	DefaultNotifyMethod = "terminal-notifier"
+	DefaultFetchTimeout = 10
+	DefaultFetchWorkers = 4
+	DefaultHookTimeout  = 60
+	MaxFetchWorkers     = 32
 	ConfigFileName      = "config.json"
 	StateFileName       = "state.json"
+	StatePathEnv        = "BREW_UPDATER_STATE"
+	SourceGitHub        = "github"
 )
 
 var (
 	ErrInvalidInterval = errors.New("invalid interval")
 )
 
+// concurrent API requests per host; GitHub rate-limits far more strictly than the CDN
+var DefaultHostConcurrency = map[string]int{
+	"api.github.com":   2,
+	"formulae.brew.sh": 8,
+}
+
+var IntervalPresets = map[string]int{
+	"hourly":  60,
+	"daily":   1440,
+	"weekly":  10080,
+	"monthly": 43200,
+}
+
 type Config struct {
-	Version               int         `json:"version"`
-	TickIntervalSec       int         `json:"tick_interval_sec"`
-	DefaultPolicy         string      `json:"default_policy"`
-	NotifyMethod          string      `json:"notify_method"`
-	IncludeAutoUpdateCask bool        `json:"include_auto_update_cask"`
-	Watchlist             []WatchItem `json:"watchlist"`
+	Version                 int               `json:"version"`
+	TickIntervalSec         int               `json:"tick_interval_sec"`
+	DefaultPolicy           string            `json:"default_policy"`
+	NotifyMethod            string            `json:"notify_method"`
+	IncludeAutoUpdateCask   bool              `json:"include_auto_update_cask"`
+	UserAgent               string            `json:"user_agent,omitempty"`
+	MaxVersionAgeMin        int               `json:"max_version_age_min,omitempty"`
+	NotifyThreshold         int               `json:"notify_threshold,omitempty"`
+	MaxPackagesPerRun       int               `json:"max_packages_per_run,omitempty"`
+	NotifyOpenHomepage      bool              `json:"notify_open_homepage,omitempty"`
+	APIFetchTimeoutSec      int               `json:"api_fetch_timeout_sec"`
+	PreviewUpgrades         bool              `json:"preview_upgrades,omitempty"`
+	MaxUpgradeFanout        int               `json:"max_upgrade_fanout,omitempty"`
+	PreferType              string            `json:"prefer_type,omitempty"`
+	MaxErrorsAbort          int               `json:"max_errors_abort,omitempty"`
+	ContinueOnUpdateFailure bool              `json:"continue_on_update_failure,omitempty"`
+	PackageHooks            map[string]string `json:"package_hooks,omitempty"`
+	HookTimeoutSec          int               `json:"hook_timeout_sec,omitempty"`
+	BrewRetries             int               `json:"brew_retries,omitempty"`
+	NotifyOnError           bool              `json:"notify_on_error,omitempty"`
+	GreedyCasks             []string          `json:"greedy_casks,omitempty"`
+	LogFormat               string            `json:"log_format,omitempty"`
+	UpgradeGracePeriodMin   int               `json:"upgrade_grace_period_min,omitempty"`
+	HealthFile              string            `json:"health_file,omitempty"`
+	HostConcurrency         map[string]int    `json:"host_concurrency,omitempty"`
+	QuietIfUnchanged        bool              `json:"quiet_if_unchanged,omitempty"`
+	OnBattery               string            `json:"on_battery,omitempty"`
+	NetworkRequired         bool              `json:"network_required,omitempty"`
+	NotifyOnRemoved         bool              `json:"notify_on_removed,omitempty"`
+	DeferCasks              bool              `json:"defer_casks,omitempty"`
+	CaskUpgradeWindow       string            `json:"cask_upgrade_window,omitempty"`
+	APIRequestsPerHour      int               `json:"api_requests_per_hour,omitempty"`
+	MaxUpgradeSizeMB        int               `json:"max_upgrade_size_mb,omitempty"`
+	NotifyTitleTemplate     string            `json:"notify_title_template,omitempty"`
+	NotifyMessageTemplate   string            `json:"notify_message_template,omitempty"`
+	APIMaxAttempts          int               `json:"api_max_attempts,omitempty"`
+	Proxy                   string            `json:"proxy,omitempty"`
+	FetchConcurrency        int               `json:"fetch_concurrency,omitempty"`
+	Watchlist               []WatchItem       `json:"watchlist"`
 }
 
 type WatchItem struct {
-	Name        string    `json:"name"`
-	Type        string    `json:"type"`
-	Policy      string    `json:"policy,omitempty"`
-	IntervalMin int       `json:"interval_min"`
-	AddedAt     time.Time `json:"added_at"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Policy       string    `json:"policy,omitempty"`
+	IntervalMin  int       `json:"interval_min"`
+	AddedAt      time.Time `json:"added_at"`
+	ResolvedName string    `json:"resolved_name,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	Repo         string    `json:"repo,omitempty"`
+	Constraint   string    `json:"constraint,omitempty"`
 }
 
 func DefaultConfig() Config {
@@ -49,6 +111,9 @@ func DefaultConfig() Config {
 		DefaultPolicy:         DefaultPolicy,
 		NotifyMethod:          DefaultNotifyMethod,
 		IncludeAutoUpdateCask: true,
+		APIFetchTimeoutSec:    DefaultFetchTimeout,
+		FetchConcurrency:      DefaultFetchWorkers,
+		HookTimeoutSec:        DefaultHookTimeout,
 		Watchlist:             []WatchItem{},
 	}
 }
@@ -76,6 +141,16 @@ func StatePathFromConfigPath(configPath string) string {
 	return filepath.Join(filepath.Dir(configPath), StateFileName)
 }
 
+func ResolveStatePath(path string, configPath string) string {
+	if path != "" {
+		return path
+	}
+	if env := os.Getenv(StatePathEnv); env != "" {
+		return env
+	}
+	return StatePathFromConfigPath(configPath)
+}
+
 func EnsureDir(path string) error {
 	dir := filepath.Dir(path)
 	return os.MkdirAll(dir, 0o755)
@@ -107,7 +182,31 @@ func SaveConfig(path string, cfg Config) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0o644)
+	return WriteFileAtomic(path, data, 0o644)
+}
+
+// WriteFileAtomic writes via a temp file and rename so readers never see a
+// partial file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
 func NormalizeConfig(cfg Config) (Config, error) {
@@ -118,6 +217,74 @@ func NormalizeConfig(cfg Config) (Config, error) {
 	if cfg.NotifyMethod == "" {
 		cfg.NotifyMethod = DefaultNotifyMethod
 	}
+	if cfg.MaxVersionAgeMin < 0 {
+		cfg.MaxVersionAgeMin = 0
+	}
+	if cfg.NotifyThreshold < 0 {
+		cfg.NotifyThreshold = 0
+	}
+	if cfg.MaxPackagesPerRun < 0 {
+		cfg.MaxPackagesPerRun = 0
+	}
+	if cfg.PreferType != "" && cfg.PreferType != "formula" && cfg.PreferType != "cask" {
+		return cfg, fmt.Errorf("invalid prefer_type: %s", cfg.PreferType)
+	}
+	if cfg.LogFormat != "" && cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return cfg, fmt.Errorf("invalid log_format: %s", cfg.LogFormat)
+	}
+	if err := ValidateOnBattery(cfg.OnBattery); err != nil {
+		return cfg, err
+	}
+	if cfg.CaskUpgradeWindow != "" {
+		if _, _, err := ParseWindow(cfg.CaskUpgradeWindow); err != nil {
+			return cfg, fmt.Errorf("invalid cask_upgrade_window: %w", err)
+		}
+	}
+	if _, err := NotifyTemplate("notify_title_template", cfg.NotifyTitleTemplate); err != nil {
+		return cfg, err
+	}
+	if _, err := NotifyTemplate("notify_message_template", cfg.NotifyMessageTemplate); err != nil {
+		return cfg, err
+	}
+	if cfg.UpgradeGracePeriodMin < 0 {
+		cfg.UpgradeGracePeriodMin = 0
+	}
+	if cfg.MaxUpgradeSizeMB < 0 {
+		cfg.MaxUpgradeSizeMB = 0
+	}
+	if cfg.Proxy != "" {
+		if u, err := url.Parse(cfg.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			return cfg, fmt.Errorf("invalid proxy: %q (want e.g. http://host:port)", cfg.Proxy)
+		}
+	}
+	if cfg.APIMaxAttempts < 0 {
+		cfg.APIMaxAttempts = 0
+	}
+	if cfg.APIRequestsPerHour < 0 {
+		cfg.APIRequestsPerHour = 0
+	}
+	if cfg.MaxErrorsAbort < 0 {
+		cfg.MaxErrorsAbort = 0
+	}
+	if cfg.BrewRetries < 0 {
+		cfg.BrewRetries = 0
+	}
+	if cfg.MaxUpgradeFanout < 0 {
+		cfg.MaxUpgradeFanout = 0
+	}
+	for host, n := range cfg.HostConcurrency {
+		if n < 1 || n > 32 {
+			return cfg, fmt.Errorf("invalid host_concurrency for %s: %d (must be 1-32)", host, n)
+		}
+	}
+	// clamped rather than rejected: a bad value shouldn't stop checks
+	cfg.FetchConcurrency = min(max(cfg.FetchConcurrency, 1), MaxFetchWorkers)
+	if cfg.HookTimeoutSec <= 0 {
+		cfg.HookTimeoutSec = DefaultHookTimeout
+	}
+	if cfg.APIFetchTimeoutSec <= 0 {
+		cfg.APIFetchTimeoutSec = DefaultFetchTimeout
+	}
 	deduped := make([]WatchItem, 0, len(cfg.Watchlist))
 	seen := make(map[string]int)
 	now := time.Now()
@@ -128,6 +295,9 @@ func NormalizeConfig(cfg Config) (Config, error) {
 		if err := ValidateInterval(item.IntervalMin); err != nil {
 			return cfg, fmt.Errorf("invalid interval for %s: %w", item.Name, err)
 		}
+		if err := ValidateSource(item.Source, item.Repo); err != nil {
+			return cfg, fmt.Errorf("invalid source for %s: %w", item.Name, err)
+		}
 		if item.AddedAt.IsZero() {
 			item.AddedAt = now
 		}
@@ -146,6 +316,46 @@ func NormalizeConfig(cfg Config) (Config, error) {
 	return cfg, nil
 }
 
+const (
+	MergeKeepMine   = "keep-mine"
+	MergeKeepTheirs = "keep-theirs"
+	MergeNewest     = "newest"
+)
+
+// MergeWatchlist adds theirs to mine. Items watched in both are resolved by
+// strategy; MergeNewest keeps the one with the later AddedAt.
+func MergeWatchlist(mine []WatchItem, theirs []WatchItem, strategy string) ([]WatchItem, int, int, error) {
+	switch strategy {
+	case MergeKeepMine, MergeKeepTheirs, MergeNewest:
+	default:
+		return nil, 0, 0, fmt.Errorf("invalid merge strategy: %s (want %s|%s|%s)", strategy, MergeKeepMine, MergeKeepTheirs, MergeNewest)
+	}
+	merged := append([]WatchItem{}, mine...)
+	idx := make(map[string]int, len(mine))
+	for i, item := range mine {
+		idx[WatchKey(item.Name, item.Type)] = i
+	}
+	added, updated := 0, 0
+	for _, item := range theirs {
+		i, ok := idx[WatchKey(item.Name, item.Type)]
+		if !ok {
+			idx[WatchKey(item.Name, item.Type)] = len(merged)
+			merged = append(merged, item)
+			added++
+			continue
+		}
+		if strategy == MergeKeepMine || merged[i] == item {
+			continue
+		}
+		if strategy == MergeNewest && !item.AddedAt.After(merged[i].AddedAt) {
+			continue
+		}
+		merged[i] = item
+		updated++
+	}
+	return merged, added, updated, nil
+}
+
 func WatchKey(name string, typ string) string {
 	if typ == "" {
 		return name
@@ -153,6 +363,90 @@ func WatchKey(name string, typ string) string {
 	return typ + ":" + name
 }
 
+// ParseInterval accepts minutes or a preset name (hourly, daily, weekly, monthly)
+func ParseInterval(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, ok := IntervalPresets[s]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidInterval, s)
+	}
+	if err := ValidateInterval(n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+var repoPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+func ValidateSource(source string, repo string) error {
+	switch source {
+	case "", "brew":
+		return nil
+	case SourceGitHub:
+		if !repoPattern.MatchString(repo) {
+			return fmt.Errorf("repo must be owner/name, got %q", repo)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown source %q", source)
+}
+
+// ParseWindow parses a daily "HH:MM-HH:MM" window into offsets from midnight;
+// the end may be earlier than the start for windows spanning midnight
+func ParseWindow(s string) (time.Duration, time.Duration, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("want HH:MM-HH:MM, got %q", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("want HH:MM-HH:MM, got %q", s)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, fmt.Errorf("want HH:MM-HH:MM, got %q", s)
+	}
+	midnight := time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)
+	return start.Sub(midnight), end.Sub(midnight), nil
+}
+
+// fields available to notify_title_template and notify_message_template
+type NotifyFields struct {
+	Name      string
+	Type      string
+	Installed string
+	Latest    string
+	Action    string
+}
+
+// NotifyTemplate parses a notification template and checks that it only
+// references NotifyFields; an empty text yields a nil template.
+func NotifyTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if err := t.Execute(io.Discard, NotifyFields{}); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// run upgrades as usual, or skip them (notify only) while on battery
+func ValidateOnBattery(mode string) error {
+	switch mode {
+	case "", "run", "skip":
+		return nil
+	}
+	return fmt.Errorf("invalid on_battery: %s (want run|skip)", mode)
+}
+
 func ValidateInterval(min int) error {
 	if min < MinIntervalMin || min > MaxIntervalMin {
 		return ErrInvalidInterval
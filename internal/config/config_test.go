@@ -0,0 +1,86 @@
+package config
+
+import "testing"
+
+func TestNormalizeConfigKeepsFormulaAndCask(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Watchlist = []WatchItem{
+		{Name: "docker", Type: "formula"},
+		{Name: "docker", Type: "cask", Policy: "notify"},
+		{Name: "docker", Type: "cask", Policy: "auto"},
+	}
+	cfg, err := NormalizeConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Watchlist) != 2 {
+		t.Fatalf("watchlist = %+v, want one formula and one cask", cfg.Watchlist)
+	}
+	if cfg.Watchlist[0].Type != "formula" || cfg.Watchlist[1].Type != "cask" {
+		t.Errorf("types = %s, %s, want formula, cask", cfg.Watchlist[0].Type, cfg.Watchlist[1].Type)
+	}
+	// the later duplicate of the same type wins
+	if cfg.Watchlist[1].Policy != "auto" {
+		t.Errorf("cask policy = %q, want auto", cfg.Watchlist[1].Policy)
+	}
+}
+
+func TestNormalizeConfigClamps(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*Config)
+		check func(Config) bool
+	}{
+		{"fetch concurrency default", func(c *Config) {}, func(c Config) bool { return c.FetchConcurrency == DefaultFetchWorkers }},
+		{"fetch concurrency low", func(c *Config) { c.FetchConcurrency = 0 }, func(c Config) bool { return c.FetchConcurrency == 1 }},
+		{"fetch concurrency negative", func(c *Config) { c.FetchConcurrency = -3 }, func(c Config) bool { return c.FetchConcurrency == 1 }},
+		{"fetch concurrency high", func(c *Config) { c.FetchConcurrency = 100 }, func(c Config) bool { return c.FetchConcurrency == MaxFetchWorkers }},
+		{"fetch concurrency in range", func(c *Config) { c.FetchConcurrency = 12 }, func(c Config) bool { return c.FetchConcurrency == 12 }},
+		{"hook timeout", func(c *Config) { c.HookTimeoutSec = -1 }, func(c Config) bool { return c.HookTimeoutSec == DefaultHookTimeout }},
+		{"fetch timeout", func(c *Config) { c.APIFetchTimeoutSec = 0 }, func(c Config) bool { return c.APIFetchTimeoutSec == DefaultFetchTimeout }},
+		{"api max attempts", func(c *Config) { c.APIMaxAttempts = -2 }, func(c Config) bool { return c.APIMaxAttempts == 0 }},
+		{"max upgrade size", func(c *Config) { c.MaxUpgradeSizeMB = -1 }, func(c Config) bool { return c.MaxUpgradeSizeMB == 0 }},
+		{"requests per hour", func(c *Config) { c.APIRequestsPerHour = -1 }, func(c Config) bool { return c.APIRequestsPerHour == 0 }},
+		{"notify threshold", func(c *Config) { c.NotifyThreshold = -5 }, func(c Config) bool { return c.NotifyThreshold == 0 }},
+		{"empty policy", func(c *Config) { c.DefaultPolicy = "" }, func(c Config) bool { return c.DefaultPolicy == DefaultPolicy }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.edit(&cfg)
+			got, err := NormalizeConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(got) {
+				t.Errorf("normalized config = %+v", got)
+			}
+		})
+	}
+}
+
+func TestNormalizeConfigRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*Config)
+	}{
+		{"prefer type", func(c *Config) { c.PreferType = "both" }},
+		{"log format", func(c *Config) { c.LogFormat = "xml" }},
+		{"on battery", func(c *Config) { c.OnBattery = "maybe" }},
+		{"cask window", func(c *Config) { c.CaskUpgradeWindow = "late" }},
+		{"host concurrency", func(c *Config) { c.HostConcurrency = map[string]int{"api.github.com": 0} }},
+		{"proxy", func(c *Config) { c.Proxy = "proxy.example:3128" }},
+		{"title template", func(c *Config) { c.NotifyTitleTemplate = "{{.Version}}" }},
+		{"message template", func(c *Config) { c.NotifyMessageTemplate = "{{.Name" }},
+		{"interval", func(c *Config) { c.Watchlist = []WatchItem{{Name: "git", Type: "formula", IntervalMin: -1}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.edit(&cfg)
+			if _, err := NormalizeConfig(cfg); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
@@ -7,22 +7,93 @@ import (
 )
 
 type State struct {
-	LastCheckAt  *time.Time        `json:"last_check_at,omitempty"`
-	LastUpdateAt *time.Time        `json:"last_update_at,omitempty"`
-	LastVersions map[string]string `json:"last_versions"`
-	LastSchemes  map[string]int    `json:"last_schemes"`
-	ETagCache    map[string]string `json:"etag_cache"`
-	LastErrors   []string          `json:"last_errors"`
-	NextCheckAt  map[string]string `json:"next_check_at"`
+	LastCheckAt        *time.Time         `json:"last_check_at,omitempty"`
+	LastUpdateAt       *time.Time         `json:"last_update_at,omitempty"`
+	LastCheckFormulaAt *time.Time         `json:"last_check_formula_at,omitempty"`
+	LastCheckCaskAt    *time.Time         `json:"last_check_cask_at,omitempty"`
+	LastErrorNotifyAt  *time.Time         `json:"last_error_notify_at,omitempty"`
+	LastVersions       map[string]string  `json:"last_versions"`
+	LastSchemes        map[string]int     `json:"last_schemes"`
+	ETagCache          map[string]string  `json:"etag_cache"`
+	LastModified       map[string]string  `json:"last_modified"`
+	LastErrors         []string           `json:"last_errors"`
+	LastRunErrors      int                `json:"last_run_errors,omitempty"`
+	NextCheckAt        map[string]string  `json:"next_check_at"`
+	LastFetchAt        map[string]string  `json:"last_fetch_at"`
+	Pending            map[string]Pending `json:"pending_outdated"`
+	Baselines          map[string]string  `json:"baselines"`
+	VersionFirstSeen   map[string]string  `json:"version_first_seen"`
+	FetchFailures      map[string]int     `json:"fetch_failures"`
+	History            map[string][]Check `json:"history"`
+	DeferredCasks      map[string]string  `json:"deferred_casks"`
+	TooLarge           map[string]string  `json:"too_large"`
+	Held               map[string]string  `json:"held"`
+	APIBudget          *Budget            `json:"api_budget,omitempty"`
+	WarnedUnwritable   bool               `json:"warned_unwritable,omitempty"`
+}
+
+// token bucket shared by every run, refilled at api_requests_per_hour
+type Budget struct {
+	Tokens     float64   `json:"tokens"`
+	RefilledAt time.Time `json:"refilled_at"`
+}
+
+// recent check outcomes kept per package
+const HistorySize = 10
+
+type Check struct {
+	At       time.Time `json:"at"`
+	Latest   string    `json:"latest,omitempty"`
+	Outdated bool      `json:"outdated,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (st *State) RecordCheck(key string, c Check) {
+	h := append(st.History[key], c)
+	if len(h) > HistorySize {
+		h = h[len(h)-HistorySize:]
+	}
+	st.History[key] = h
+}
+
+func (st State) LastCheckFor(typ string) *time.Time {
+	switch typ {
+	case "formula":
+		return st.LastCheckFormulaAt
+	case "cask":
+		return st.LastCheckCaskAt
+	}
+	return st.LastCheckAt
+}
+
+func VersionKey(key string, version string) string {
+	return key + "@" + version
+}
+
+type Pending struct {
+	Installed string `json:"installed"`
+	Latest    string `json:"latest"`
+	Homepage  string `json:"homepage,omitempty"`
+	URL       string `json:"url,omitempty"`
 }
 
 func DefaultState() State {
 	return State{
-		LastVersions: make(map[string]string),
-		LastSchemes:  make(map[string]int),
-		ETagCache:    make(map[string]string),
-		LastErrors:   []string{},
-		NextCheckAt:  make(map[string]string),
+		LastVersions:     make(map[string]string),
+		LastSchemes:      make(map[string]int),
+		ETagCache:        make(map[string]string),
+		LastModified:     make(map[string]string),
+		LastErrors:       []string{},
+		NextCheckAt:      make(map[string]string),
+		LastFetchAt:      make(map[string]string),
+		Pending:          make(map[string]Pending),
+		Baselines:        make(map[string]string),
+		VersionFirstSeen: make(map[string]string),
+		FetchFailures:    make(map[string]int),
+		History:          make(map[string][]Check),
+		DeferredCasks:    make(map[string]string),
+		TooLarge:         make(map[string]string),
+		Held:             make(map[string]string),
 	}
 }
 
@@ -50,9 +121,39 @@ func LoadState(path string) (State, error) {
 	if st.ETagCache == nil {
 		st.ETagCache = make(map[string]string)
 	}
+	if st.LastModified == nil {
+		st.LastModified = make(map[string]string)
+	}
 	if st.NextCheckAt == nil {
 		st.NextCheckAt = make(map[string]string)
 	}
+	if st.LastFetchAt == nil {
+		st.LastFetchAt = make(map[string]string)
+	}
+	if st.Pending == nil {
+		st.Pending = make(map[string]Pending)
+	}
+	if st.Baselines == nil {
+		st.Baselines = make(map[string]string)
+	}
+	if st.VersionFirstSeen == nil {
+		st.VersionFirstSeen = make(map[string]string)
+	}
+	if st.FetchFailures == nil {
+		st.FetchFailures = make(map[string]int)
+	}
+	if st.History == nil {
+		st.History = make(map[string][]Check)
+	}
+	if st.DeferredCasks == nil {
+		st.DeferredCasks = make(map[string]string)
+	}
+	if st.TooLarge == nil {
+		st.TooLarge = make(map[string]string)
+	}
+	if st.Held == nil {
+		st.Held = make(map[string]string)
+	}
 	if st.LastErrors == nil {
 		st.LastErrors = []string{}
 	}
@@ -0,0 +1,38 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Run runs command with sh, killing it once timeout passes (0 means no
+// limit beyond ctx).
+func Run(ctx context.Context, command string, env map[string]string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	// background children can hold stderr open after sh is killed
+	cmd.WaitDelay = time.Second
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("hook %q timed out after %s", command, timeout)
+		}
+		return fmt.Errorf("hook %q failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
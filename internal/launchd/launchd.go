@@ -2,17 +2,23 @@ package launchd
 
 import (
 	"bytes"
+	"encoding/xml"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/samzong/brew-updater/internal/config"
 )
 
 const (
 	Label = "dev.brew-updater"
+	// launchd ticks every 60s while awake, so a gap this long means sleep
+	WakeResumeGap = "5m"
 )
 
 func PlistPath() (string, error) {
@@ -31,7 +37,7 @@ func LogsPath() (string, error) {
 	return filepath.Join(home, "Library", "Logs", "brew-updater.log"), nil
 }
 
-func Install(binaryPath, configPath string, startNow bool) (string, error) {
+func Install(binaryPath, configPath string, startNow bool, extraArgs []string) (string, error) {
 	plistPath, err := PlistPath()
 	if err != nil {
 		return "", err
@@ -47,8 +53,11 @@ func Install(binaryPath, configPath string, startNow bool) (string, error) {
 		return "", err
 	}
 
-	plist := renderPlist(binaryPath, configPath, logPath, startNow)
-	if err := os.WriteFile(plistPath, []byte(plist), 0o644); err != nil {
+	// unload any previous agent so a half-finished install is reconciled
+	_ = bootout(plistPath)
+
+	plist := renderPlist(binaryPath, configPath, logPath, startNow, extraArgs)
+	if err := config.WriteFileAtomic(plistPath, []byte(plist), 0o644); err != nil {
 		return "", err
 	}
 
@@ -58,6 +67,18 @@ func Install(binaryPath, configPath string, startNow bool) (string, error) {
 	return plistPath, nil
 }
 
+// Load bootstraps the already installed plist without rewriting it.
+func Load() error {
+	plistPath, err := PlistPath()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(plistPath); err != nil {
+		return err
+	}
+	return bootstrap(plistPath)
+}
+
 func Uninstall() error {
 	plistPath, err := PlistPath()
 	if err != nil {
@@ -76,11 +97,87 @@ func Status() (bool, error) {
 	return strings.Contains(string(out), Label), nil
 }
 
-func renderPlist(binaryPath, configPath, logPath string, startNow bool) string {
+type Info struct {
+	Loaded         bool
+	PID            int
+	LastExitStatus string
+	StartInterval  time.Duration
+	PlistPath      string
+	LogPath        string
+}
+
+// Describe reports what launchctl knows about the agent. `launchctl print`
+// (10.10+) is tried first, then the older `launchctl list <label>`.
+func Describe() (Info, error) {
+	info := Info{}
+	plistPath, err := PlistPath()
+	if err != nil {
+		return info, err
+	}
+	info.PlistPath = plistPath
+	if info.LogPath, err = LogsPath(); err != nil {
+		return info, err
+	}
+	if data, err := os.ReadFile(plistPath); err == nil {
+		info.StartInterval = parseStartInterval(string(data))
+	}
+	uid := strconv.Itoa(os.Getuid())
+	if out, err := exec.Command("/bin/launchctl", "print", "gui/"+uid+"/"+Label).Output(); err == nil {
+		info.Loaded = true
+		parsePrint(string(out), &info)
+		return info, nil
+	}
+	if out, err := exec.Command("/bin/launchctl", "list", Label).Output(); err == nil {
+		info.Loaded = true
+		parseList(string(out), &info)
+	}
+	return info, nil
+}
+
+var (
+	startIntervalRe = regexp.MustCompile(`<key>StartInterval</key>\s*<integer>(\d+)</integer>`)
+	printPIDRe      = regexp.MustCompile(`(?m)^\s*pid = (\d+)`)
+	printExitRe     = regexp.MustCompile(`(?m)^\s*last exit (?:code|status) = (.+)$`)
+	listPIDRe       = regexp.MustCompile(`"PID" = (\d+);`)
+	listExitRe      = regexp.MustCompile(`"LastExitStatus" = (-?\d+);`)
+)
+
+func parseStartInterval(plist string) time.Duration {
+	m := startIntervalRe.FindStringSubmatch(plist)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return time.Duration(n) * time.Second
+}
+
+func parsePrint(out string, info *Info) {
+	if m := printPIDRe.FindStringSubmatch(out); m != nil {
+		info.PID, _ = strconv.Atoi(m[1])
+	}
+	if m := printExitRe.FindStringSubmatch(out); m != nil {
+		info.LastExitStatus = strings.TrimSpace(m[1])
+	}
+}
+
+func parseList(out string, info *Info) {
+	if m := listPIDRe.FindStringSubmatch(out); m != nil {
+		info.PID, _ = strconv.Atoi(m[1])
+	}
+	if m := listExitRe.FindStringSubmatch(out); m != nil {
+		info.LastExitStatus = m[1]
+	}
+}
+
+func renderPlist(binaryPath, configPath, logPath string, startNow bool, extraArgs []string) string {
 	runAtLoad := ""
 	if startNow {
 		runAtLoad = "<key>RunAtLoad</key>\n  <true/>"
 	}
+	extra := ""
+	for _, arg := range extraArgs {
+		extra += "\n    <string>" + escape(arg) + "</string>"
+	}
 	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0">
@@ -92,7 +189,7 @@ func renderPlist(binaryPath, configPath, logPath string, startNow bool) string {
     <string>%s</string>
     <string>check</string>
     <string>--config</string>
-    <string>%s</string>
+    <string>%s</string>%s
   </array>
   %s
   <key>StartInterval</key>
@@ -109,7 +206,13 @@ func renderPlist(binaryPath, configPath, logPath string, startNow bool) string {
   <string>Background</string>
 </dict>
 </plist>
-`, Label, binaryPath, configPath, runAtLoad, logPath, logPath)
+`, Label, escape(binaryPath), escape(configPath), extra, runAtLoad, escape(logPath), escape(logPath))
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
 }
 
 func bootstrap(plistPath string) error {
@@ -130,7 +233,12 @@ func bootstrap(plistPath string) error {
 
 func bootout(plistPath string) error {
 	uid := strconv.Itoa(os.Getuid())
-	cmd := exec.Command("/bin/launchctl", "bootout", "gui/"+uid, plistPath)
-	_ = cmd.Run()
+	// bootout by label works even when the plist is missing or truncated
+	if err := exec.Command("/bin/launchctl", "bootout", "gui/"+uid+"/"+Label).Run(); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(plistPath); err == nil {
+		_ = exec.Command("/bin/launchctl", "unload", plistPath).Run()
+	}
 	return nil
 }
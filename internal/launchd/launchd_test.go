@@ -0,0 +1,174 @@
+package launchd
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPlistEscapesArgs(t *testing.T) {
+	plist := renderPlist("/opt/a&b/brew-updater", "/tmp/config.json", "/tmp/log", false, []string{"--health-file", "/tmp/<x>&y"})
+	d := xml.NewDecoder(strings.NewReader(plist))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("plist is not valid XML: %v\n%s", err, plist)
+		}
+	}
+	for _, want := range []string{"<string>/opt/a&amp;b/brew-updater</string>", "<string>/tmp/&lt;x&gt;&amp;y</string>"} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist missing %s", want)
+		}
+	}
+}
+
+func TestRenderPlist(t *testing.T) {
+	tests := []struct {
+		name     string
+		startNow bool
+		extra    []string
+		want     []string
+		absent   []string
+	}{
+		{
+			name:   "defaults",
+			want:   []string{"<string>check</string>", "<string>--config</string>", "<string>/c.json</string>", "<integer>60</integer>"},
+			absent: []string{"RunAtLoad", "--resume-gap"},
+		},
+		{
+			name:     "check on wake",
+			startNow: true,
+			extra:    []string{"--resume-gap", WakeResumeGap},
+			want:     []string{"<key>RunAtLoad</key>", "<string>/c.json</string>\n    <string>--resume-gap</string>\n    <string>5m</string>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plist := renderPlist("/bin/brew-updater", "/c.json", "/log", tt.startNow, tt.extra)
+			for _, s := range tt.want {
+				if !strings.Contains(plist, s) {
+					t.Errorf("plist missing %q", s)
+				}
+			}
+			for _, s := range tt.absent {
+				if strings.Contains(plist, s) {
+					t.Errorf("plist unexpectedly contains %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseStartInterval(t *testing.T) {
+	plist := renderPlist("/bin/brew-updater", "/c.json", "/log", false, nil)
+	if got := parseStartInterval(plist); got != time.Minute {
+		t.Errorf("parseStartInterval = %s, want 1m", got)
+	}
+	if got := parseStartInterval("<plist/>"); got != 0 {
+		t.Errorf("parseStartInterval without key = %s, want 0", got)
+	}
+}
+
+// trimmed `launchctl print gui/501/dev.brew-updater` output
+const printIdle = `gui/501/dev.brew-updater = {
+	active count = 0
+	path = /Users/me/Library/LaunchAgents/dev.brew-updater.plist
+	type = LaunchAgent
+	state = not running
+
+	program = /opt/homebrew/bin/brew-updater
+	arguments = {
+		/opt/homebrew/bin/brew-updater
+		check
+	}
+
+	stdout path = /Users/me/Library/Logs/brew-updater.log
+	runs = 42
+	last exit code = 1
+	run interval = 60 seconds
+}
+`
+
+const printRunning = `gui/501/dev.brew-updater = {
+	active count = 1
+	path = /Users/me/Library/LaunchAgents/dev.brew-updater.plist
+	type = LaunchAgent
+	state = running
+
+	program = /opt/homebrew/bin/brew-updater
+	runs = 1
+	pid = 8123
+	immediate reason = interval
+	last exit code = (never exited)
+}
+`
+
+func TestParsePrint(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want Info
+	}{
+		{"idle", printIdle, Info{LastExitStatus: "1"}},
+		{"running", printRunning, Info{PID: 8123, LastExitStatus: "(never exited)"}},
+		{"empty", "", Info{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var info Info
+			parsePrint(tt.out, &info)
+			if info != tt.want {
+				t.Errorf("parsePrint = %+v, want %+v", info, tt.want)
+			}
+		})
+	}
+}
+
+// trimmed `launchctl list dev.brew-updater` output
+const listRunning = `{
+	"StandardOutPath" = "/Users/me/Library/Logs/brew-updater.log";
+	"LimitLoadToSessionType" = "Aqua";
+	"Label" = "dev.brew-updater";
+	"OnDemand" = true;
+	"LastExitStatus" = 256;
+	"PID" = 8123;
+	"Program" = "/opt/homebrew/bin/brew-updater";
+	"ProgramArguments" = (
+		"/opt/homebrew/bin/brew-updater";
+		"check";
+	);
+};
+`
+
+const listIdle = `{
+	"Label" = "dev.brew-updater";
+	"OnDemand" = true;
+	"LastExitStatus" = 0;
+};
+`
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want Info
+	}{
+		{"running", listRunning, Info{PID: 8123, LastExitStatus: "256"}},
+		{"idle", listIdle, Info{LastExitStatus: "0"}},
+		{"empty", "", Info{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var info Info
+			parseList(tt.out, &info)
+			if info != tt.want {
+				t.Errorf("parseList = %+v, want %+v", info, tt.want)
+			}
+		})
+	}
+}
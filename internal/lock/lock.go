@@ -10,10 +10,23 @@ import (
 	"time"
 )
 
+var ErrLocked = errors.New("lock already held")
+
 type Lock struct {
 	path string
 }
 
+func AcquireWait(path string, timeout time.Duration, wait time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		l, err := Acquire(path, timeout)
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			return l, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 func Acquire(path string, timeout time.Duration) (*Lock, error) {
 	for {
 		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
@@ -34,8 +47,17 @@ func Acquire(path string, timeout time.Duration) (*Lock, error) {
 			_ = os.Remove(path)
 			continue
 		}
-		return nil, errors.New("lock already held")
+		return nil, ErrLocked
+	}
+}
+
+// Stale reports whether a lock file exists that Acquire would take over.
+func Stale(path string, timeout time.Duration) (bool, error) {
+	stale, err := isStale(path, timeout)
+	if os.IsNotExist(err) {
+		return false, nil
 	}
+	return stale, err
 }
 
 func isStale(path string, timeout time.Duration) (bool, error) {
@@ -0,0 +1,24 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger that writes one JSON object per event for FormatJSON
+// and key=value lines for FormatText.
+func New(w io.Writer, format string) (*slog.Logger, error) {
+	switch format {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("invalid log format: %s", format)
+}
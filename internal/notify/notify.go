@@ -8,11 +8,22 @@ type Notifier struct {
 	method string
 }
 
+type Message struct {
+	Title   string
+	Body    string
+	Execute string
+	Open    string
+}
+
 func New(method string) *Notifier {
 	return &Notifier{method: method}
 }
 
 func (n *Notifier) Notify(title, message, execute string) error {
+	return n.Send(Message{Title: title, Body: message, Execute: execute})
+}
+
+func (n *Notifier) Send(m Message) error {
 	if n.method != "terminal-notifier" {
 		return nil
 	}
@@ -20,9 +31,11 @@ func (n *Notifier) Notify(title, message, execute string) error {
 	if err != nil {
 		return err
 	}
-	args := []string{"-title", title, "-message", message}
-	if execute != "" {
-		args = append(args, "-execute", execute)
+	args := []string{"-title", m.Title, "-message", m.Body}
+	if m.Open != "" {
+		args = append(args, "-open", m.Open)
+	} else if m.Execute != "" {
+		args = append(args, "-execute", m.Execute)
 	}
 	cmd := exec.Command(path, args...)
 	return cmd.Run()
@@ -0,0 +1,22 @@
+package power
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// OnBattery reports whether the Mac is running on battery power.
+// Machines without a battery always report false.
+func OnBattery() (bool, error) {
+	out, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return false, err
+	}
+	return parseBatt(string(out)), nil
+}
+
+// first line reads "Now drawing from 'Battery Power'" or "'AC Power'"
+func parseBatt(out string) bool {
+	first, _, _ := strings.Cut(out, "\n")
+	return strings.Contains(first, "'Battery Power'")
+}
@@ -2,17 +2,20 @@ package tui
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 	"text/tabwriter"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/samzong/brew-updater/internal/config"
 )
 
 type Item struct {
-	Name string
-	Type string
+	Name      string
+	Type      string
+	Installed string
+	Latest    string
 }
 
 type Selection struct {
@@ -44,12 +47,14 @@ type model struct {
 	defaultPolicy   string
 	defaultInterval int
 	cancelled       bool
+	showVersions    bool
 	width           int
 	height          int
 }
 
-func RunWatch(items []Item, defaultPolicy string, defaultInterval int, preset map[string]Selection) ([]Selection, bool, error) {
+func RunWatch(items []Item, defaultPolicy string, defaultInterval int, preset map[string]Selection, showVersions bool) ([]Selection, bool, error) {
 	m := newModel(items, defaultPolicy, defaultInterval, preset)
+	m.showVersions = showVersions
 	p := tea.NewProgram(m)
 	res, err := p.Run()
 	if err != nil {
@@ -62,6 +67,11 @@ func RunWatch(items []Item, defaultPolicy string, defaultInterval int, preset ma
 	return final.selectedItems(), false, nil
 }
 
+// Preselected returns what RunWatch would return if confirmed without changes.
+func Preselected(items []Item, defaultPolicy string, defaultInterval int, preset map[string]Selection) []Selection {
+	return newModel(items, defaultPolicy, defaultInterval, preset).selectedItems()
+}
+
 func newModel(items []Item, defaultPolicy string, defaultInterval int, preset map[string]Selection) model {
 	ti := textinput.New()
 	ti.CharLimit = 64
@@ -133,9 +143,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.status = "interval empty"
 					return m, nil
 				}
-				n, err := strconv.Atoi(val)
-				if err != nil || n < 1 || n > 1440 {
-					m.status = "interval must be 1-1440"
+				n, err := config.ParseInterval(val)
+				if err != nil {
+					m.status = fmt.Sprintf("interval must be %d-%d or hourly/daily/weekly/monthly", config.MinIntervalMin, config.MaxIntervalMin)
 					return m, nil
 				}
 				for name := range m.selected {
@@ -184,11 +194,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 			case "i":
 				m.mode = modeInterval
-				m.input.Placeholder = "interval (1-1440)"
+				m.input.Placeholder = fmt.Sprintf("interval (%d-%d, hourly, daily, weekly, monthly)", config.MinIntervalMin, config.MaxIntervalMin)
 				m.input.Focus()
 				return m, nil
 			case "p":
 				m.togglePolicy()
+			case "v":
+				m.showVersions = !m.showVersions
 			case "enter":
 				return m, tea.Quit
 			}
@@ -230,12 +242,16 @@ func (m model) View() string {
 			}
 			policy := m.policyValue(key)
 			interval := m.intervalValue(key)
-			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\tpolicy=%s\tinterval=%dm\n", cursor, checked, item.Name, item.Type, policy, interval)
+			if m.showVersions {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\tpolicy=%s\tinterval=%dm\n", cursor, checked, item.Name, item.Type, versionValue(item.Installed), versionValue(item.Latest), policy, interval)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\tpolicy=%s\tinterval=%dm\n", cursor, checked, item.Name, item.Type, policy, interval)
+			}
 		}
 		_ = tw.Flush()
 	}
 
-	b.WriteString("\nKeys: up/down=j/k/ctrl+n/ctrl+p | space=toggle | a=all/unall | x=invert | /=search | i=interval | p=policy | enter=save | q=quit\n")
+	b.WriteString("\nKeys: up/down=j/k/ctrl+n/ctrl+p | space=toggle | a=all/unall | x=invert | /=search | i=interval | p=policy | v=versions | enter=save | q=quit\n")
 	if m.mode == modeSearch {
 		b.WriteString("Search: " + m.input.View() + "\n")
 	}
@@ -482,6 +498,13 @@ func (m model) visibleRange(total int) (int, int) {
 	return start, end
 }
 
+func versionValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
 func itemKey(item Item) string {
 	return selectionKey(item.Name, item.Type)
 }
@@ -0,0 +1,166 @@
+package version
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Ordering of an installed version relative to the latest one.
+type Ordering int
+
+const (
+	// Equal also covers pairs that cannot be compared: an empty version or
+	// the "latest" sentinel used by unversioned casks.
+	Equal Ordering = iota
+	Older
+	Newer
+	// Different means both versions are set but neither parses, so only
+	// inequality is known.
+	Different
+)
+
+type Options struct {
+	// Homebrew version_scheme of the latest and the previously seen release;
+	// a bump is an epoch change that outranks the version string.
+	Scheme     int
+	PrevScheme int
+}
+
+// Compare reports how installed relates to latest. It understands Homebrew
+// revisions ("1.2.3_1"), version_scheme epochs and cask "version,build" strings.
+func Compare(installed, latest string, opts Options) Ordering {
+	if installed == "" || latest == "" {
+		return Equal
+	}
+	if isLatest(installed) || isLatest(latest) {
+		return Equal
+	}
+	if installed == latest {
+		return Equal
+	}
+	if opts.Scheme > opts.PrevScheme {
+		return Older
+	}
+	if strings.Contains(installed, ",") || strings.Contains(latest, ",") {
+		return compareCask(installed, latest)
+	}
+	instBase, instRev := splitRevision(installed)
+	latBase, latRev := splitRevision(latest)
+	if o := compareBase(instBase, latBase); o != Equal {
+		return o
+	}
+	return compareInts(instRev, latRev)
+}
+
+// Outdated reports whether latest should replace installed.
+func Outdated(installed, latest string, opts Options) bool {
+	o := Compare(installed, latest, opts)
+	return o == Older || o == Different
+}
+
+func Normalize(v string) string {
+	v = strings.TrimSpace(v)
+	v = strings.TrimPrefix(v, "v")
+	v = strings.ReplaceAll(v, "_", ".")
+	v = strings.ReplaceAll(v, ",", ".")
+	return v
+}
+
+func isLatest(v string) bool {
+	return strings.EqualFold(strings.TrimSpace(v), "latest")
+}
+
+// "1.2.3_2" is revision 2 of 1.2.3; versions without a suffix are revision 0
+func splitRevision(v string) (string, int) {
+	i := strings.LastIndex(v, "_")
+	if i < 0 {
+		return v, 0
+	}
+	rev, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return v, 0
+	}
+	return v[:i], rev
+}
+
+func compareBase(installed, latest string) Ordering {
+	if installed == latest {
+		return Equal
+	}
+	iv, err1 := semver.NewVersion(Normalize(installed))
+	lv, err2 := semver.NewVersion(Normalize(latest))
+	if err1 != nil || err2 != nil {
+		return compareNumeric(Normalize(installed), Normalize(latest))
+	}
+	switch iv.Compare(lv) {
+	case -1:
+		return Older
+	case 1:
+		return Newer
+	}
+	return Equal
+}
+
+// dotted versions semver rejects, e.g. four-part 119.0.6045.159; missing
+// trailing parts count as 0
+func compareNumeric(installed, latest string) Ordering {
+	ip, ok1 := numericParts(installed)
+	lp, ok2 := numericParts(latest)
+	if !ok1 || !ok2 {
+		return Different
+	}
+	for i := range max(len(ip), len(lp)) {
+		var a, b int64
+		if i < len(ip) {
+			a = ip[i]
+		}
+		if i < len(lp) {
+			b = lp[i]
+		}
+		if o := compareInts(a, b); o != Equal {
+			return o
+		}
+	}
+	return Equal
+}
+
+func numericParts(v string) ([]int64, bool) {
+	parts := strings.Split(v, ".")
+	nums := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		nums = append(nums, n)
+	}
+	return nums, true
+}
+
+// casks use "version,build" (e.g. 119.0.6045.159,1692340000); the build only
+// breaks a tie between equal versions
+func compareCask(installed, latest string) Ordering {
+	instVersion, instBuild, _ := strings.Cut(installed, ",")
+	latVersion, latBuild, _ := strings.Cut(latest, ",")
+	if o := compareBase(instVersion, latVersion); o != Equal {
+		return o
+	}
+	ib, err1 := strconv.ParseInt(instBuild, 10, 64)
+	lb, err2 := strconv.ParseInt(latBuild, 10, 64)
+	if err1 != nil || err2 != nil {
+		return compareInts(strings.Compare(instBuild, latBuild), 0)
+	}
+	return compareInts(ib, lb)
+}
+
+func compareInts[T int | int64](installed, latest T) Ordering {
+	switch {
+	case installed < latest:
+		return Older
+	case installed > latest:
+		return Newer
+	}
+	return Equal
+}
@@ -0,0 +1,110 @@
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed string
+		latest    string
+		opts      Options
+		want      Ordering
+	}{
+		{"same", "1.2.3", "1.2.3", Options{}, Equal},
+		{"older", "1.2.3", "1.2.4", Options{}, Older},
+		{"newer", "1.3.0", "1.2.9", Options{}, Newer},
+		{"v prefix", "v1.2.3", "1.2.3", Options{}, Equal},
+		{"revision bump", "1.2", "1.2_1", Options{}, Older},
+		{"revision ahead", "1.2_2", "1.2_1", Options{}, Newer},
+		{"revision same", "1.2_1", "1.2_1", Options{}, Equal},
+		{"base beats revision", "1.2_5", "1.3", Options{}, Older},
+		{"epoch bump", "2.0", "1.0", Options{Scheme: 1, PrevScheme: 0}, Older},
+		{"epoch unchanged", "2.0", "1.0", Options{Scheme: 1, PrevScheme: 1}, Newer},
+		{"cask build", "1.0,100", "1.0,200", Options{}, Older},
+		{"cask version", "1.1,900", "1.2,100", Options{}, Older},
+		{"latest installed", "latest", "1.0", Options{}, Equal},
+		{"latest upstream", "1.0", "latest", Options{}, Equal},
+		{"latest case", "1.0", "LATEST", Options{}, Equal},
+		{"empty installed", "", "1.0", Options{}, Equal},
+		{"empty latest", "1.0", "", Options{}, Equal},
+		{"unparseable", "abc", "def", Options{}, Different},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compare(tt.installed, tt.latest, tt.opts); got != tt.want {
+				t.Errorf("Compare(%q, %q) = %v, want %v", tt.installed, tt.latest, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutdated(t *testing.T) {
+	tests := []struct {
+		installed string
+		latest    string
+		want      bool
+	}{
+		{"1.0", "1.1", true},
+		{"1.1", "1.0", false},
+		{"1.0", "1.0", false},
+		{"abc", "def", true},
+		{"latest", "2.0", false},
+	}
+	for _, tt := range tests {
+		if got := Outdated(tt.installed, tt.latest, Options{}); got != tt.want {
+			t.Errorf("Outdated(%q, %q) = %v, want %v", tt.installed, tt.latest, got, tt.want)
+		}
+	}
+}
+
+// real cask versions from formulae.brew.sh
+func TestCompareCask(t *testing.T) {
+	tests := []struct {
+		installed string
+		latest    string
+		want      Ordering
+	}{
+		{"119.0.6045.159,1692340000", "119.0.6045.159,1692340000", Equal},
+		{"119.0.6045.159,1692340000", "120.0.6099.62,1701388800", Older},
+		// a rebuilt download of the same version
+		{"2023.1,12345", "2023.1,12346", Older},
+		{"2023.1,12346", "2023.1,12345", Newer},
+		// the version outranks the build id
+		{"2023.1,99999", "2023.2,10000", Older},
+		{"2023.2,10000", "2023.1,99999", Newer},
+		// build ids are compared as numbers
+		{"1.5,9", "1.5,10", Older},
+		{"4.28.0,139021", "4.29.0,145265", Older},
+		{"3.4.1,5f1d0e0d", "3.4.1,5f1d0e0d", Equal},
+		// non-numeric builds fall back to a string compare
+		{"1.0,abc", "1.0,def", Older},
+		{"1.0,def", "1.0,abc", Newer},
+		// a build appearing on one side only
+		{"1.0", "1.0,100", Older},
+		{"17.4,2024.03", "latest", Equal},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.installed, tt.latest, Options{}); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %v, want %v", tt.installed, tt.latest, got, tt.want)
+		}
+	}
+}
+
+func TestCompareFourPart(t *testing.T) {
+	tests := []struct {
+		installed string
+		latest    string
+		want      Ordering
+	}{
+		{"119.0.6045.159", "119.0.6045.160", Older},
+		{"119.0.6045.160", "119.0.6045.159", Newer},
+		{"1.2.3.4", "1.2.3.4", Equal},
+		{"1.2.3.0", "1.2.3", Equal},
+		{"1.2.3.4a", "1.2.3.5", Different},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.installed, tt.latest, Options{}); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %v, want %v", tt.installed, tt.latest, got, tt.want)
+		}
+	}
+}